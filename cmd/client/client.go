@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
@@ -8,23 +10,40 @@ import (
 	"tcp-serv-test/internal/client"
 )
 
+// passwordEnv environment variable with user password
+const passwordEnv = "CHAT_PASSWORD"
+
 func main() {
-	arguments := os.Args
-	if len(arguments) == 1 {
+	maxAttempts := flag.Int("reconnect-attempts", 0, "reconnect attempts in a row before giving up, 0 retries forever")
+	maxBackoff := flag.Duration("max-backoff", client.DefaultMaxBackoff, "max delay between reconnect attempts")
+	nick := flag.String("nick", "", "nickname")
+	user := flag.String("user", "", "user name, password is read from "+passwordEnv)
+	flag.Parse()
+	if flag.NArg() == 0 {
 		log.Fatal("address must be provided")
 	}
 	log.Println("starting client")
-	c := client.New(arguments[1])
-	go c.Start()
-	waitStopSignal(c)
+	c := client.New(flag.Arg(0))
+	c.MaxAttempts = *maxAttempts
+	c.MaxBackoff = *maxBackoff
+	c.Nick = *nick
+	c.User, c.Password = *user, os.Getenv(passwordEnv)
+	if err := c.Run(waitStopSignal(context.Background())); err != nil {
+		log.Fatalf("connection dropped message: %s", err)
+	}
+	log.Println("stopped")
 }
 
-func waitStopSignal(c *client.Client) {
+// waitStopSignal returns context cancelled by stop signal
+func waitStopSignal(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 
-	<-ch
-	log.Println("stopping client")
-	c.Stop()
-	log.Println("stopped")
+	go func() {
+		<-ch
+		log.Println("stopping client")
+		cancel()
+	}()
+	return ctx
 }
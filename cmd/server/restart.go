@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"tcp-serv-test/internal/server"
+	"time"
+)
+
+// handoffEnv is set for the restarted child, it inherits descriptors:
+// 3 - pipe with handoff state, 4 - listener, 5 and further - client connections
+const handoffEnv = "CHAT_SERVER_HANDOFF"
+
+const (
+	stateFD    = 3
+	listenerFD = 4
+	connFD     = 5
+)
+
+// handoffTimeout time for flushing client connections before restart
+const handoffTimeout = 30 * time.Second
+
+type handoffState struct {
+	Conns []server.HandoffConn `json:"conns"`
+	Rooms []server.HandoffRoom `json:"rooms"`
+}
+
+// inherited reports whether the process is started by restart
+func inherited() bool {
+	return os.Getenv(handoffEnv) != ""
+}
+
+// inherit returns listener, client connections and rooms passed by the parent process
+func inherit() (net.Listener, *handoffState, error) {
+	_ = os.Unsetenv(handoffEnv)
+	stateFile := os.NewFile(stateFD, "handoff-state")
+	defer stateFile.Close()
+	var state handoffState
+	if err := json.NewDecoder(stateFile).Decode(&state); err != nil {
+		return nil, nil, fmt.Errorf("can't read handoff state: %w", err)
+	}
+	for i := range state.Conns {
+		state.Conns[i].File = os.NewFile(uintptr(connFD+i), "conn-"+state.Conns[i].ID)
+	}
+
+	lf := os.NewFile(listenerFD, "listener")
+	defer lf.Close()
+	l, err := net.FileListener(lf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, &state, nil
+}
+
+// restartReconnectHint time after which clients may reconnect to the new process when connections are not kept
+const restartReconnectHint = time.Second
+
+// restart execs the server binary again passing it the listener and, with keepConns, live client connections.
+// Without keepConns clients get shutdown frame with reconnect hint and reconnect to the new process.
+// stopped reports whether srv no longer serves clients, so a failed restart can't be retried
+func restart(srv *server.Server, keepConns bool) (stopped bool, err error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return false, err
+	}
+	lf, err := srv.ListenerFile()
+	if err != nil {
+		return false, err
+	}
+	defer lf.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	defer w.Close()
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), handoffEnv+"=1")
+	cmd.ExtraFiles = []*os.File{r, lf}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handoffTimeout)
+	defer cancel()
+	var state handoffState
+	if keepConns {
+		// server stops serving here, every failure after it is fatal
+		if state.Conns, err = srv.Handoff(ctx); err != nil {
+			return true, err
+		}
+		state.Rooms = srv.HandoffRooms()
+		for _, hc := range state.Conns {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, hc.File)
+		}
+	}
+
+	err = cmd.Start()
+	for _, hc := range state.Conns {
+		_ = hc.File.Close()
+	}
+	if err != nil {
+		return keepConns, err
+	}
+	if err = json.NewEncoder(w).Encode(state); err != nil {
+		// child can't read the state and exits
+		return keepConns, err
+	}
+
+	if !keepConns {
+		srv.StopReconnect(ctx, restartReconnectHint)
+	}
+	return true, nil
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,30 +13,90 @@ import (
 )
 
 func main() {
-	ctx := context.Background()
-	arguments := os.Args
-	if len(arguments) == 1 {
+	keepConns := flag.Bool("keep-connections", true, "pass live client connections to the new process on restart, otherwise clients are told to reconnect")
+	htpasswd := flag.String("htpasswd", "", "password file of \"user:hash\" lines with bcrypt or scrypt hashes, clients must authenticate if set")
+	resumeWindow := flag.Duration("resume-window", 30*time.Second, "time a disconnected client may resume its session, 0 disables resumption")
+	flag.Parse()
+	if flag.NArg() == 0 {
 		log.Fatal("address must be provided")
 	}
-	log.Println("starting server")
-	srv := server.New(arguments[1])
-	go srv.Serve()
-	waitStopSignal(ctx, srv)
+	address := flag.Arg(0)
+
+	var l net.Listener
+	state := &handoffState{}
+	var err error
+	if inherited() {
+		log.Println("restarting server")
+		l, state, err = inherit()
+		if err != nil {
+			log.Fatalf("can't inherit listener: %s", err)
+		}
+	} else {
+		log.Println("starting server")
+		l, err = net.Listen("tcp", address)
+		if err != nil {
+			log.Fatalf("can't listen on %s: %s", address, err)
+		}
+	}
+	opts := []server.Option{server.WithListener(l), server.WithResumeWindow(*resumeWindow)}
+	if *htpasswd != "" {
+		users, authErr := server.NewFileAuthenticator(*htpasswd)
+		if authErr != nil {
+			log.Fatalf("can't load password file: %s", authErr)
+		}
+		opts = append(opts, server.WithAuthenticator(users))
+	}
+	srv := server.New(address, opts...)
+	srv.AdoptRooms(state.Rooms)
+	if err = srv.Adopt(state.Conns); err != nil {
+		log.Printf("can't adopt connections: %s", err)
+	}
+
+	ctx, restarts := waitStopSignal(context.Background())
+	ran := make(chan error, 1)
+	go func() {
+		ran <- srv.Run(ctx)
+	}()
+	for {
+		select {
+		case err = <-ran:
+			if err != nil {
+				log.Fatalf("server failed: %s", err)
+			}
+			log.Println("stopped")
+			return
+		case <-restarts:
+			log.Println("restarting server")
+			stopped, restartErr := restart(srv, *keepConns)
+			if restartErr != nil && stopped {
+				log.Fatalf("restart failed, server is stopped: %s", restartErr)
+			}
+			if restartErr != nil {
+				log.Printf("restart failed, server keeps running: %s", restartErr)
+				continue
+			}
+			log.Println("handed off to the new process")
+			return
+		}
+	}
 }
 
-func waitStopSignal(ctx context.Context, srv *server.Server) {
+// waitStopSignal returns context cancelled by the first stop signal, the second signal kills the server.
+// Restart signals are sent to the returned channel
+func waitStopSignal(ctx context.Context) (context.Context, <-chan os.Signal) {
+	ctx, cancel := context.WithCancel(ctx)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	restarts := make(chan os.Signal, 1)
+	signal.Notify(restarts, syscall.SIGHUP, syscall.SIGUSR2)
 
-	<-c
-	log.Println("stopping server")
-	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
 	go func() {
 		<-c
-		log.Println("force stopping server")
+		log.Println("stopping server")
 		cancel()
+		<-c
+		log.Println("force stopping server")
+		os.Exit(1)
 	}()
-	srv.Stop(ctx)
-
-	log.Println("stopped")
+	return ctx, restarts
 }
@@ -2,6 +2,9 @@ module tcp-serv-test
 
 go 1.17
 
-require github.com/satori/go.uuid v1.2.0
+require (
+	github.com/satori/go.uuid v1.2.0
+	golang.org/x/crypto v0.1.0
+)
 
 require gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
@@ -2,169 +2,518 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"tcp-serv-test/internal/message"
 )
 
-type messageContent struct {
-	headerType int
-	content    string
-}
+// capabilities supported by client
+var capabilities = []string{message.CapCompression, message.CapChecksum, message.CapSync}
 
 // Client tcp chat client
 type Client struct {
+	// MaxAttempts count of reconnect attempts in a row before Run gives up, 0 retries forever
+	MaxAttempts int
+	// MinBackoff delay before the first reconnect attempt, it doubles with every failed attempt
+	MinBackoff time.Duration
+	// MaxBackoff max delay between reconnect attempts
+	MaxBackoff time.Duration
+	// InputBuffer max size of messages typed while disconnected, they are sent after reconnect
+	InputBuffer int
+	// Nick nickname set after connecting, it is changed by /nick command
+	Nick string
+	// User and Password credentials sent in handshake, empty User sends none
+	User     string
+	Password string
+
 	address string
-	clients map[string]bool
-	conn    net.Conn
-	stops   bool
+	id      string
+	// token resumes session after reconnect
+	token string
+	caps  map[string]bool
+	// clients nicknames of known clients by ID, empty for clients without nickname
+	clients map[string]string
+	// rooms joined rooms, they are joined again when session is not resumed
+	rooms  map[string]bool
+	conn   net.Conn
+	reader *message.Reader
+	writer *message.Writer
+	// mu guards conn, writer, online and pending input
+	mu     sync.Mutex
+	online bool
+	// pending messages typed while disconnected
+	pending     []*message.Frame
+	pendingSize int
+	// quit is closed when client stops
+	quit     chan struct{}
+	quitOnce sync.Once
 }
 
 // New creates new Client
 func New(address string) *Client {
 	return &Client{
-		address: address,
-		clients: map[string]bool{},
+		MinBackoff:  DefaultMinBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+		InputBuffer: DefaultInputBuffer,
+		address:     address,
+		clients:     map[string]string{},
+		rooms:       map[string]bool{},
+		quit:        make(chan struct{}),
 	}
 }
 
-// Start starts chat client
+// Start starts chat client, it exits the process when client can't connect
 func (c *Client) Start() {
-	addr, err := net.ResolveTCPAddr("tcp", c.address)
-	if err != nil {
-		log.Fatalf("wrong server address %s", c.address)
+	if err := c.Run(context.Background()); err != nil {
+		log.Fatalf("connection dropped message: %s", err.Error())
 	}
-	conn, err := net.DialTCP("tcp", nil, addr)
-	if err != nil {
-		log.Fatalf(err.Error())
+}
+
+// Run connects to server and chats until ctx is done or Stop is called, dropped connection
+// is restored with growing delays and server shutdown with reconnect hint after the hint. It returns the first fatal error or nil if client is stopped
+func (c *Client) Run(ctx context.Context) error {
+	defer c.Stop()
+	go c.listenInput()
+
+	for attempt := 0; ; {
+		connected, err := c.session(ctx)
+		if c.stopping() || ctx.Err() != nil {
+			return nil
+		}
+		var protoErr *message.ProtocolError
+		if errors.As(err, &protoErr) {
+			// server rejects client, retrying does not help
+			return err
+		}
+		if connected {
+			attempt = 0
+		}
+		attempt++
+		if c.MaxAttempts > 0 && attempt > c.MaxAttempts {
+			return fmt.Errorf("can't reconnect after %d attempts: %w", c.MaxAttempts, err)
+		}
+
+		delay := c.backoff(attempt)
+		var shutdown *shutdownError
+		if errors.As(err, &shutdown) {
+			delay = shutdown.reconnect
+		}
+		fmt.Printf("connection lost: %s, reconnecting in %s…\n", err, delay.Round(100*time.Millisecond))
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		case <-c.quit:
+			t.Stop()
+			return nil
+		}
 	}
-	c.conn = conn
+}
 
-	err = conn.SetKeepAlive(true)
+// session connects to server and serves connection until it fails, connected tells whether handshake is done
+func (c *Client) session(ctx context.Context) (connected bool, err error) {
+	dialer := net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", c.address)
 	if err != nil {
-		log.Println(err)
-		return
+		return false, err
 	}
-	err = conn.SetKeepAlivePeriod(30 * time.Second)
-	if err != nil {
-		log.Println(err)
-		return
+	c.mu.Lock()
+	if c.stopping() {
+		c.mu.Unlock()
+		_ = conn.Close()
+		return false, nil
 	}
+	c.conn = conn
+	c.reader = message.NewReader(conn, message.DefaultMaxSize)
+	c.writer = message.NewWriter(conn)
+	c.mu.Unlock()
+	defer c.disconnect()
 
-	notify := make(chan error)
+	if err = c.handshake(); err != nil {
+		return false, fmt.Errorf("handshake failed: %w", err)
+	}
+	c.goOnline()
 
+	notify := make(chan error, 1)
 	go c.listenMessages(notify)
-	go c.listenInput(notify)
+	select {
+	case err = <-notify:
+	case <-ctx.Done():
+	case <-c.quit:
+	}
+	return true, err
+}
 
-	err = <-notify
+// handshake sends hello with credentials and waits for the assigned ID and the agreed capabilities
+func (c *Client) handshake() error {
+	err := c.writer.Write(message.Resume(capabilities, c.token))
 	if err != nil {
-		log.Fatalf("connection dropped message: %s", err.Error())
+		return err
+	}
+	if c.User != "" {
+		if err = c.writer.Write(message.Auth(c.User, c.Password)); err != nil {
+			return err
+		}
 	}
+
+	f, err := c.reader.Read()
+	if err != nil {
+		return err
+	}
+	switch f.Type {
+	case message.HeaderTypeWelcome:
+	case message.HeaderTypeError:
+		protoErr, parseErr := message.ParseError(f)
+		if parseErr != nil {
+			return parseErr
+		}
+		return protoErr
+	default:
+		return fmt.Errorf("unexpected handshake reply type %d", f.Type)
+	}
+
+	agreed, token := message.ParseHandshake(f)
+	resumed := c.id != "" && c.id == f.Recipient
+	c.id, c.token = f.Recipient, token
+	c.caps = map[string]bool{}
+	for _, capability := range agreed {
+		c.caps[capability] = true
+	}
+	c.reader.SetSync(c.caps[message.CapSync])
+	c.writer.SetSync(c.caps[message.CapSync])
+	c.writer.SetChecksum(c.caps[message.CapChecksum])
+	c.writer.SetCompression(c.caps[message.CapCompression], message.DefaultCompressThreshold)
+	c.reader.OnSkip = func(n int) {
+		log.Printf("skipped %d bytes of corrupted data", n)
+	}
+	if resumed {
+		log.Printf("session resumed as %s", c.id)
+		return nil
+	}
+	// server sends member lists to new session
+	c.clients = map[string]string{}
+	log.Printf("connected as %s", c.id)
+	return c.rejoin()
 }
 
-func (c *Client) listenInput(notify chan error) {
-	func() {
-		reader := bufio.NewReader(os.Stdin)
-		for {
-			input, err := reader.ReadString('\n')
-			if err != nil {
-				notify <- err
-				return
-			}
-			m, err := message.Encode(fmt.Sprintf("%s%s", "[client-message]", strings.Trim(input, "\n ")))
-			if err != nil {
-				notify <- err
-				return
-			}
-			_, err = c.conn.Write(m)
-			if err != nil {
-				if c.stops {
-					close(notify)
-					return
-				}
-				notify <- err
-				return
-			}
+// rejoin sets nickname, authenticated clients have user name as nickname, and joins rooms of the previous session
+func (c *Client) rejoin() error {
+	if c.Nick != "" && c.User == "" {
+		if err := c.writer.Write(message.SetNick(c.Nick)); err != nil {
+			return err
 		}
-	}()
+	}
+	for name := range c.rooms {
+		if err := c.writer.Write(message.JoinRoom(name)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (c *Client) listenMessages(notify chan error) {
+// listenInput sends lines typed by user, lines typed while disconnected are sent after reconnect
+func (c *Client) listenInput() {
+	reader := bufio.NewReader(os.Stdin)
 	for {
-		msg, err := message.Read(c.conn)
+		input, err := reader.ReadString('\n')
 		if err != nil {
-			if c.stops {
-				close(notify)
-				return
-			}
-			notify <- err
+			c.Stop()
 			return
 		}
-		content, err := message.Decode(msg)
+		f, err := c.inputFrame(strings.Trim(input, "\n "))
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		c.input(f)
+	}
+}
+
+// send writes frame to server, long messages are sent in fragments
+func send(w *message.Writer, f *message.Frame) error {
+	for _, fragment := range message.Split(f, message.DefaultFragmentSize) {
+		if err := w.Write(fragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) listenMessages(notify chan error) {
+	reassembler := message.NewReassembler(message.DefaultMaxSize)
+	for {
+		fragment, err := c.reader.ReadView()
+		var checksumErr *message.ChecksumError
+		if errors.As(err, &checksumErr) {
+			log.Printf("dropped corrupted message: %s", err)
+			continue
+		}
 		if err != nil {
 			notify <- err
 			return
 		}
-
-		messageVal, err := c.getMessageVal(content)
+		f, err := reassembler.Add(fragment)
 		if err != nil {
-			log.Println("unexpected message format")
+			log.Printf("dropped message from %s: %s", fragment.Sender, err)
+			continue
+		}
+		if f == nil {
+			continue
 		}
 
-		switch messageVal.headerType {
+		var content string
+		switch f.Type {
+		case message.HeaderTypePing:
+			if err = c.writer.Write(message.Pong(f)); err != nil {
+				log.Printf("can't reply to ping: %s", err)
+			}
+			continue
 		case message.HeaderTypeNewClient:
-			c.clients[content] = true
-			content = "new client: " + messageVal.content
+			room := message.Room(f)
+			if f.Sender == c.id {
+				c.rooms[room] = true
+				content = "joined " + message.RoomRecipient(room)
+				break
+			}
+			c.clients[f.Sender] = message.Nick(f)
+			content = fmt.Sprintf("new client in %s: %s", message.RoomRecipient(room), c.name(f.Sender))
 		case message.HeaderTypeClientList:
-			c.clients[content] = true
-			content = "existed client: " + messageVal.content
+			c.clients[f.Sender] = message.Nick(f)
+			content = fmt.Sprintf("existed client in %s: %s", message.RoomRecipient(message.Room(f)), c.name(f.Sender))
+		case message.HeaderTypeLeaveRoom:
+			room := message.Room(f)
+			if f.Sender == c.id {
+				delete(c.rooms, room)
+				content = "left " + message.RoomRecipient(room)
+				break
+			}
+			content = fmt.Sprintf("client left %s: %s", message.RoomRecipient(room), c.name(f.Sender))
 		case message.HeaderTypeDisconnectClient:
-			delete(c.clients, content)
-			content = "client disconnected: " + messageVal.content
+			c.clients[f.Sender] = message.Nick(f)
+			content = fmt.Sprintf("client disconnected: %s (%s)", c.name(f.Sender), message.ReasonText(message.DisconnectReason(f)))
+			delete(c.clients, f.Sender)
+			reassembler.Discard(f.Sender)
+		case message.HeaderTypeSetNick:
+			if f.Sender == c.id {
+				c.Nick = message.Nick(f)
+				content = "you are now known as " + c.Nick
+				break
+			}
+			content = fmt.Sprintf("%s is now known as %s", c.name(f.Sender), message.Nick(f))
+			c.clients[f.Sender] = message.Nick(f)
+		case message.HeaderTypeInvite:
+			room := message.RoomRecipient(message.Room(f))
+			if f.Sender == c.id {
+				content = fmt.Sprintf("invited %s to %s", c.name(f.Recipient), room)
+				break
+			}
+			content = fmt.Sprintf("%s invites you to %s, /join %s to accept", c.name(f.Sender), room, room)
+		case message.HeaderTypeRoomList:
+			rooms, parseErr := message.ParseRoomList(f)
+			if parseErr != nil {
+				log.Println("unexpected message format")
+				continue
+			}
+			content = roomDirectory(rooms)
+		case message.HeaderTypeSetTopic:
+			room, topic := message.ParseTopic(f)
+			switch {
+			case f.Sender == "":
+				content = fmt.Sprintf("topic of %s: %s", message.RoomRecipient(room), topic)
+			case topic == "":
+				content = fmt.Sprintf("%s cleared topic of %s", c.name(f.Sender), message.RoomRecipient(room))
+			default:
+				content = fmt.Sprintf("%s changed topic of %s: %s", c.name(f.Sender), message.RoomRecipient(room), topic)
+			}
 		case message.HeaderTypeClientMessage:
-			content = messageVal.content
+			content = fmt.Sprintf("%s: %s", c.name(f.Sender), f.Payload)
+			if _, ok := message.RoomName(f.Recipient); ok {
+				content = f.Recipient + " " + content
+			}
+		case message.HeaderTypeGoodbye:
+			// server closes connection right after goodbye, it is not a failure
+			fmt.Println("disconnected by server: " + message.ReasonText(message.DisconnectReason(f)))
+			c.Stop()
+			continue
+		case message.HeaderTypeShutdown:
+			notice, parseErr := message.ParseShutdown(f)
+			if parseErr != nil {
+				log.Println("unexpected message format")
+				continue
+			}
+			fmt.Println(shutdownText(notice))
+			if notice.Reconnect > 0 {
+				// server is restarting, Run reconnects after the hint
+				notify <- &shutdownError{reconnect: notice.Reconnect}
+				return
+			}
+			c.Stop()
+			continue
+		case message.HeaderTypeError:
+			protoErr, parseErr := message.ParseError(f)
+			if parseErr != nil {
+				log.Println("unexpected message format")
+				continue
+			}
+			content = "error: " + protoErr.Text
+		default:
+			log.Println("unexpected message format")
+			continue
 		}
 
 		fmt.Println(content)
 	}
 }
 
-func (c Client) getMessageVal(content string) (messageContent, error) {
-	if strings.HasPrefix(content, message.NewClientHeaderPrefix) {
-		return messageContent{
-			message.HeaderTypeNewClient,
-			strings.TrimPrefix(content, message.NewClientHeaderPrefix),
-		}, nil
+// name returns nickname of client or its ID if client has no nickname
+func (c *Client) name(id string) string {
+	if nick := c.clients[id]; nick != "" {
+		return nick
+	}
+	return id
+}
+
+// inputFrame builds client message or room request from input line, "@<client-id or nick> text" is a direct message,
+// "#<room> text" is a room message, lines starting with "/" are commands
+func (c *Client) inputFrame(input string) (*message.Frame, error) {
+	if strings.HasPrefix(input, "/") {
+		return command(input)
+	}
+
+	f := &message.Frame{
+		Version: message.Version,
+		Type:    message.HeaderTypeClientMessage,
+		Payload: []byte(input),
+	}
+	if !strings.HasPrefix(input, "@") && !strings.HasPrefix(input, message.RoomPrefix) {
+		return f, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(input, "@"), " ", 2)
+	f.Recipient = parts[0]
+	f.Payload = nil
+	if len(parts) == 2 {
+		f.Payload = []byte(parts[1])
+	}
+	return f, nil
+}
+
+// command builds request from command line
+func command(input string) (*message.Frame, error) {
+	args := strings.Fields(input)
+	switch {
+	case len(args) == 1 && args[0] == "/rooms":
+		return message.ListRooms(), nil
+	case len(args) == 2 && args[0] == "/nick":
+		return message.SetNick(args[1]), nil
+	case len(args) >= 2 && args[0] == "/topic":
+		parts := strings.SplitN(input, " ", 3)
+		topic := ""
+		if len(parts) == 3 {
+			topic = strings.TrimSpace(parts[2])
+		}
+		return message.SetTopic(strings.TrimPrefix(args[1], message.RoomPrefix), topic), nil
 	}
-	if strings.HasPrefix(content, message.ClientsListHeaderPrefix) {
-		return messageContent{
-			message.HeaderTypeClientList,
-			strings.TrimPrefix(content, message.ClientsListHeaderPrefix),
-		}, nil
+	if len(args) < 2 || len(args) > 3 {
+		return nil, errors.New(commandUsage)
 	}
-	if strings.HasPrefix(content, message.ClientDisconnectHeaderPrefix) {
-		return messageContent{
-			message.HeaderTypeDisconnectClient,
-			strings.TrimPrefix(content, message.ClientDisconnectHeaderPrefix),
-		}, nil
+	name := strings.TrimPrefix(args[1], message.RoomPrefix)
+	var arg string
+	if len(args) == 3 {
+		arg = args[2]
 	}
-	if strings.HasPrefix(content, message.ClientMessageHeaderPrefix) {
-		return messageContent{
-			message.HeaderTypeClientMessage,
-			strings.TrimPrefix(content, message.ClientMessageHeaderPrefix),
-		}, nil
+	switch args[0] {
+	case "/join":
+		return message.JoinRoomWith(name, message.RoomOptions{Password: arg}), nil
+	case "/private":
+		return message.JoinRoomWith(name, message.RoomOptions{Private: true, Password: arg}), nil
+	case "/invite":
+		if arg == "" {
+			return nil, errors.New(commandUsage)
+		}
+		return message.Invite(name, arg), nil
+	case "/leave":
+		return message.LeaveRoom(name), nil
+	default:
+		return nil, fmt.Errorf("unknown command %s\n%s", args[0], commandUsage)
 	}
-	return messageContent{}, errors.New("wrong message format")
 }
 
+const commandUsage = `commands:
+/join <room> [password]     join or create room
+/private <room> [password]  create private room
+/invite <room> <client-id>  invite client to your room
+/leave <room>               leave room
+/rooms                      list rooms
+/topic <room> [text]        set or clear room topic
+/nick <name>                change nickname`
+
 // Stop stops chat client
 func (c *Client) Stop() {
-	c.stops = true
-	_ = c.conn.Close()
+	c.quitOnce.Do(func() {
+		close(c.quit)
+	})
+	c.mu.Lock()
+	if c.online {
+		// server keeps session of clients disconnected without goodbye
+		_ = c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = c.writer.Write(message.Goodbye(message.ReasonLeft))
+	}
+	c.mu.Unlock()
+	c.disconnect()
+}
+
+func (c *Client) stopping() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// roomDirectory formats room list
+func roomDirectory(rooms []message.RoomInfo) string {
+	if len(rooms) == 0 {
+		return "no rooms"
+	}
+	lines := []string{"rooms:"}
+	for _, r := range rooms {
+		line := fmt.Sprintf("  %s (%d members, %s)", message.RoomRecipient(r.Name), r.Members, message.VisibilityText(r.Visibility))
+		if r.Topic != "" {
+			line += " - " + r.Topic
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// shutdownError ends session when server shuts down with reconnect hint
+type shutdownError struct {
+	reconnect time.Duration
+}
+
+func (e *shutdownError) Error() string {
+	return "server is shutting down"
+}
+
+// shutdownText formats server shutdown announcement
+func shutdownText(notice *message.ShutdownNotice) string {
+	text := "server is shutting down"
+	if notice.Text != "" {
+		text += ": " + notice.Text
+	}
+	if notice.Reconnect > 0 {
+		text += fmt.Sprintf(", reconnect in %s", notice.Reconnect)
+	}
+	return text
 }
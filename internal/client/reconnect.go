@@ -0,0 +1,108 @@
+package client
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"tcp-serv-test/internal/message"
+)
+
+// Reconnect defaults
+const (
+	DefaultMinBackoff  = 500 * time.Millisecond
+	DefaultMaxBackoff  = 30 * time.Second
+	DefaultInputBuffer = 64 << 10
+)
+
+// dialTimeout time for connecting to server
+const dialTimeout = 10 * time.Second
+
+// backoff returns delay before reconnect attempt, it doubles with every attempt up to MaxBackoff.
+// The delay is jittered, so clients dropped together do not reconnect at once
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.MaxBackoff
+	if attempt < 32 {
+		if exp := c.MinBackoff << uint(attempt-1); exp > 0 && exp < d {
+			d = exp
+		}
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// input sends message or keeps it until reconnect. The socket is written without the lock,
+// so disconnect can close it under a blocked write
+func (c *Client) input(f *message.Frame) {
+	for {
+		c.mu.Lock()
+		if !c.online {
+			c.keep(f)
+			c.mu.Unlock()
+			return
+		}
+		w := c.writer
+		c.mu.Unlock()
+
+		if err := send(w, f); err == nil {
+			return
+		}
+		c.mu.Lock()
+		if c.writer == w {
+			c.online = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+// keep puts message into pending input, it is called with the lock held
+func (c *Client) keep(f *message.Frame) {
+	if c.pendingSize+len(f.Payload) > c.InputBuffer {
+		fmt.Println("not connected, message dropped: input buffer is full")
+		return
+	}
+	c.pending = append(c.pending, f)
+	c.pendingSize += len(f.Payload)
+	fmt.Println("not connected, message will be sent after reconnect")
+}
+
+// goOnline sends messages typed while disconnected and lets input go to server directly.
+// Messages typed during the flush are pending too, so they are sent after the earlier ones
+func (c *Client) goOnline() {
+	for {
+		c.mu.Lock()
+		if len(c.pending) == 0 {
+			c.pending = nil
+			c.online = true
+			c.mu.Unlock()
+			return
+		}
+		batch, w := c.pending, c.writer
+		c.pending, c.pendingSize = nil, 0
+		c.mu.Unlock()
+
+		for i, f := range batch {
+			if err := send(w, f); err != nil {
+				c.mu.Lock()
+				c.pending = append(batch[i:], c.pending...)
+				for _, rest := range batch[i:] {
+					c.pendingSize += len(rest.Payload)
+				}
+				c.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// disconnect closes connection, input is kept until reconnect
+func (c *Client) disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.online = false
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+}
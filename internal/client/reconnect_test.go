@@ -0,0 +1,115 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"tcp-serv-test/internal/message"
+)
+
+func TestClient_Backoff(t *testing.T) {
+	c := New("")
+	c.MinBackoff = 100 * time.Millisecond
+	c.MaxBackoff = 2 * time.Second
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{5, 1600 * time.Millisecond},
+		{6, 2 * time.Second},
+		{40, 2 * time.Second},
+		{1000, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := c.backoff(tt.attempt); d < tt.max/2 || d > tt.max {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", tt.attempt, d, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestClient_InputBuffer(t *testing.T) {
+	c := New("")
+	c.InputBuffer = 10
+	c.input(textFrame("first"))
+	c.input(textFrame("second"))
+	c.input(textFrame("third!"))
+	if len(c.pending) != 1 || string(c.pending[0].Payload) != "first" {
+		t.Fatalf("pending = %d messages, want only the first one", len(c.pending))
+	}
+	if c.pendingSize != len("first") {
+		t.Errorf("pending size = %d, want %d", c.pendingSize, len("first"))
+	}
+}
+
+func TestClient_GoOnline(t *testing.T) {
+	c := New("")
+	c.InputBuffer = DefaultInputBuffer
+	c.input(textFrame("a"))
+	c.input(textFrame("b"))
+
+	server, conn := net.Pipe()
+	defer server.Close()
+	c.conn, c.writer = conn, message.NewWriter(conn)
+	got := make(chan string, 3)
+	go func() {
+		for {
+			f, err := message.Read(server)
+			if err != nil {
+				close(got)
+				return
+			}
+			got <- string(f.Payload)
+		}
+	}()
+
+	c.goOnline()
+	c.input(textFrame("c"))
+	for _, want := range []string{"a", "b", "c"} {
+		if payload := <-got; payload != want {
+			t.Fatalf("server got %q, want %q", payload, want)
+		}
+	}
+	if len(c.pending) != 0 || c.pendingSize != 0 {
+		t.Errorf("pending = %d messages of %d bytes after goOnline, want none", len(c.pending), c.pendingSize)
+	}
+}
+
+func TestClient_InputBlockedWrite(t *testing.T) {
+	c := New("")
+	server, conn := net.Pipe()
+	defer server.Close()
+	c.conn, c.writer = conn, message.NewWriter(conn)
+	c.online = true
+
+	// nobody reads the pipe, so the write blocks until disconnect closes it
+	done := make(chan struct{})
+	go func() {
+		c.input(textFrame("stuck"))
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	disconnected := make(chan struct{})
+	go func() {
+		c.disconnect()
+		close(disconnected)
+	}()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("disconnect is blocked by input")
+	}
+	<-done
+	if len(c.pending) != 1 {
+		t.Errorf("pending = %d messages, want the unsent one", len(c.pending))
+	}
+}
+
+func textFrame(text string) *message.Frame {
+	return &message.Frame{Version: message.Version, Type: message.HeaderTypeClientMessage, Payload: []byte(text)}
+}
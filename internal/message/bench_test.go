@@ -0,0 +1,152 @@
+package message
+
+import (
+	"io"
+	"testing"
+)
+
+// repeatReader endlessly repeats data
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.data[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.data)
+	}
+	return n, nil
+}
+
+func benchFrame() *Frame {
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeClientMessage,
+		Sender:  "6b3b816a-1c63-407a-83f6-fb99f0f9f765",
+		Payload: []byte("hello, this is a regular chat message of a typical length"),
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	data, _ := Encode(benchFrame())
+	r := &repeatReader{data: data}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := Read(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReader_Read(b *testing.B) {
+	data, _ := Encode(benchFrame())
+	r := NewReader(&repeatReader{data: data}, DefaultMaxSize)
+	defer r.Release()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := r.Read(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReader_ReadView(b *testing.B) {
+	data, _ := Encode(benchFrame())
+	r := NewReader(&repeatReader{data: data}, DefaultMaxSize)
+	defer r.Release()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadView(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReader_ReadViewSync(b *testing.B) {
+	frame, _ := Encode(benchFrame())
+	data := append(Magic[:], frame...)
+	r := NewReader(&repeatReader{data: data}, DefaultMaxSize)
+	r.SetSync(true)
+	defer r.Release()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadView(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	data, _ := Encode(benchFrame())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeView(b *testing.B) {
+	data, _ := Encode(benchFrame())
+	var f Frame
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := DecodeView(data, &f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeViewIntern(b *testing.B) {
+	data, _ := Encode(benchFrame())
+	ids := map[string]string{}
+	intern := func(id []byte) string {
+		if s, ok := ids[string(id)]; ok {
+			return s
+		}
+		s := string(id)
+		ids[s] = s
+		return s
+	}
+	var f Frame
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := DecodeViewIntern(data, &f, intern); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeWrite(b *testing.B) {
+	f := benchFrame()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := Encode(f)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = io.Discard.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriter_Write(b *testing.B) {
+	f := benchFrame()
+	w := NewWriter(io.Discard)
+	w.SetChecksum(true)
+	w.SetSync(true)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := w.Write(f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package message
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// DefaultCompressThreshold payloads shorter than threshold are sent raw
+const DefaultCompressThreshold = 512
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// Compress returns copy of frame with DEFLATE compressed payload and FlagCompressed set.
+// Frames with payload shorter than threshold or not shrinking after compression are returned as is
+func Compress(f *Frame, threshold int) (*Frame, error) {
+	if len(f.Payload) < threshold || f.Flags&FlagCompressed != 0 {
+		return f, nil
+	}
+
+	var buf bytes.Buffer
+	ok, err := compressTo(&buf, f.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return f, nil
+	}
+
+	c := *f
+	c.Flags |= FlagCompressed
+	c.Payload = buf.Bytes()
+	return &c, nil
+}
+
+// compressTo writes compressed payload to buf, reports whether compressed payload is shorter than original
+func compressTo(buf *bytes.Buffer, payload []byte) (bool, error) {
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(payload); err != nil {
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+	return buf.Len() < len(payload), nil
+}
+
+// Decompress returns copy of frame with inflated payload if FlagCompressed is set, payloads inflating over maxSize are rejected
+// with ErrTooBig. Not compressed frames are returned as is
+func Decompress(f *Frame, maxSize int) (*Frame, error) {
+	if f.Flags&FlagCompressed == 0 {
+		return f, nil
+	}
+
+	r := flate.NewReader(bytes.NewReader(f.Payload))
+	defer r.Close()
+	payload, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, ErrWrongFormat
+	}
+	if len(payload) > maxSize {
+		return nil, ErrTooBig
+	}
+	d := *f
+	d.Flags &^= FlagCompressed
+	d.Payload = payload
+	return &d, nil
+}
@@ -0,0 +1,51 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	text := bytes.Repeat([]byte("chat log line\n"), 100)
+	tests := []struct {
+		name           string
+		payload        []byte
+		threshold      int
+		wantCompressed bool
+	}{
+		{"below threshold", text, len(text) + 1, false},
+		{"compressible", text, DefaultCompressThreshold, true},
+		{"incompressible", []byte(randString(DefaultCompressThreshold)), DefaultCompressThreshold, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Frame{Version: Version, Type: HeaderTypeClientMessage, Payload: tt.payload}
+			got, err := Compress(f, tt.threshold)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got.Flags&FlagCompressed != 0) != tt.wantCompressed {
+				t.Fatalf("Compress() flags = %b, want compressed %v", got.Flags, tt.wantCompressed)
+			}
+
+			data, _ := Encode(got)
+			read, err := Read(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if read.Flags&FlagCompressed != 0 || !bytes.Equal(read.Payload, tt.payload) {
+				t.Fatalf("Read() got = %v, want original payload", read)
+			}
+		})
+	}
+}
+
+func TestDecompress_Limit(t *testing.T) {
+	f, _ := Compress(&Frame{Payload: make([]byte, 1<<20)}, 0)
+	if _, err := Decompress(f, 1<<20-1); err != ErrTooBig {
+		t.Fatalf("Decompress() error = %v, want %v", err, ErrTooBig)
+	}
+	if _, err := Decompress(&Frame{Flags: FlagCompressed, Payload: []byte("garbage")}, 1<<20); err == nil {
+		t.Fatal("Decompress() accepted garbage")
+	}
+}
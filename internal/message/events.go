@@ -0,0 +1,109 @@
+package message
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+var reasonText = map[uint8]string{
+	ReasonLeft:           "left",
+	ReasonError:          "connection error",
+	ReasonCorrupted:      "corrupted data",
+	ReasonSlowConsumer:   "slow consumer",
+	ReasonHeartbeat:      "heartbeat timeout",
+	ReasonIdle:           "idle timeout",
+	ReasonSessionExpired: "session expired",
+}
+
+// ReasonText returns human readable disconnect reason
+func ReasonText(reason uint8) string {
+	if text, ok := reasonText[reason]; ok {
+		return text
+	}
+	return "unknown reason"
+}
+
+// DisconnectClient builds HeaderTypeDisconnectClient frame with the disconnect reason and client nickname
+func DisconnectClient(id, nick string, reason uint8) *Frame {
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeDisconnectClient,
+		Sender:  id,
+		Payload: append([]byte{reason}, nick...),
+	}
+}
+
+// Goodbye builds HeaderTypeGoodbye frame telling client why server closes its connection
+func Goodbye(reason uint8) *Frame {
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeGoodbye,
+		Payload: []byte{reason},
+	}
+}
+
+// DisconnectReason returns reason of HeaderTypeDisconnectClient or HeaderTypeGoodbye frame
+func DisconnectReason(f *Frame) uint8 {
+	if len(f.Payload) == 0 {
+		return ReasonLeft
+	}
+	return f.Payload[0]
+}
+
+// Ping builds HeaderTypePing frame carrying the send time
+func Ping(t time.Time) *Frame {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(t.UnixNano()))
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypePing,
+		Payload: payload,
+	}
+}
+
+// Pong builds reply to the ping, the ping payload is echoed back
+func Pong(ping *Frame) *Frame {
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypePong,
+		Payload: append([]byte{}, ping.Payload...),
+	}
+}
+
+// PingTime returns send time carried by ping or pong frame
+func PingTime(f *Frame) (time.Time, bool) {
+	if len(f.Payload) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(f.Payload))), true
+}
+
+// ShutdownNotice server shutdown announcement
+type ShutdownNotice struct {
+	// Text operator message
+	Text string
+	// Reconnect time after which clients may reconnect, 0 if unknown
+	Reconnect time.Duration
+}
+
+// Shutdown builds HeaderTypeShutdown frame with operator message and reconnect hint
+func Shutdown(text string, reconnect time.Duration) *Frame {
+	payload := make([]byte, 4, 4+len(text))
+	binary.BigEndian.PutUint32(payload, uint32(reconnect/time.Millisecond))
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeShutdown,
+		Payload: append(payload, text...),
+	}
+}
+
+// ParseShutdown parses HeaderTypeShutdown frame
+func ParseShutdown(f *Frame) (*ShutdownNotice, error) {
+	if f.Type != HeaderTypeShutdown || len(f.Payload) < 4 {
+		return nil, ErrWrongFormat
+	}
+	return &ShutdownNotice{
+		Text:      string(f.Payload[4:]),
+		Reconnect: time.Duration(binary.BigEndian.Uint32(f.Payload)) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,30 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseShutdown(t *testing.T) {
+	got, err := ParseShutdown(Shutdown("maintenance", 90*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ShutdownNotice{Text: "maintenance", Reconnect: 90 * time.Second}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseShutdown() = %v, want %v", got, want)
+	}
+
+	if _, err = ParseShutdown(&Frame{Type: HeaderTypeShutdown, Payload: []byte{1}}); err == nil {
+		t.Error("ParseShutdown() accepted short payload")
+	}
+}
+
+func TestPingTime(t *testing.T) {
+	sent := time.Unix(0, time.Now().UnixNano())
+	got, ok := PingTime(Pong(Ping(sent)))
+	if !ok || !got.Equal(sent) {
+		t.Errorf("PingTime() = %v, %v, want %v", got, ok, sent)
+	}
+}
@@ -0,0 +1,111 @@
+package message
+
+import "errors"
+
+// DefaultFragmentSize default payload size of a fragment
+const DefaultFragmentSize = 32 << 10
+
+// Reassembler errors
+var (
+	ErrFragmentSequence = errors.New("unexpected fragment")
+	ErrReassemblyLimit  = errors.New("fragmented message is too big")
+)
+
+// IsFragment reports whether frame is a part of a fragmented message
+func (f *Frame) IsFragment() bool {
+	return f.Flags&fragmentFlags != 0
+}
+
+// Split splits frame into fragments with at most size payload bytes each,
+// frames which fit into one fragment are returned as is
+func Split(f *Frame, size int) []*Frame {
+	if size <= 0 || len(f.Payload) <= size {
+		return []*Frame{f}
+	}
+
+	frames := make([]*Frame, 0, (len(f.Payload)+size-1)/size)
+	for off := 0; off < len(f.Payload); off += size {
+		end := off + size
+		flag := uint8(FlagFragContinue)
+		switch {
+		case off == 0:
+			flag = FlagFragStart
+		case end >= len(f.Payload):
+			end = len(f.Payload)
+			flag = FlagFragEnd
+		}
+		frames = append(frames, &Frame{
+			Version:   f.Version,
+			Type:      f.Type,
+			Flags:     f.Flags&^fragmentFlags | flag,
+			Sender:    f.Sender,
+			Recipient: f.Recipient,
+			Payload:   f.Payload[off:end],
+		})
+	}
+	return frames
+}
+
+// Reassembler rebuilds fragmented messages, every sender may have one message in progress.
+// Buffered payload of all senders is limited by maxSize
+type Reassembler struct {
+	maxSize  int
+	buffered int
+	partial  map[string]*Frame
+}
+
+// NewReassembler creates new Reassembler
+func NewReassembler(maxSize int) *Reassembler {
+	return &Reassembler{
+		maxSize: maxSize,
+		partial: map[string]*Frame{},
+	}
+}
+
+// Add adds frame to reassembler, returns the whole message when the last fragment is added
+// and nil while more fragments are expected. Not fragmented frames are returned as is
+func (r *Reassembler) Add(f *Frame) (*Frame, error) {
+	if !f.IsFragment() {
+		return f, nil
+	}
+
+	p, ok := r.partial[f.Sender]
+	if f.Flags&FlagFragStart != 0 {
+		if ok {
+			r.Discard(f.Sender)
+			return nil, ErrFragmentSequence
+		}
+		p = &Frame{
+			Version:   f.Version,
+			Type:      f.Type,
+			Flags:     f.Flags &^ fragmentFlags,
+			Sender:    f.Sender,
+			Recipient: f.Recipient,
+		}
+		r.partial[f.Sender] = p
+	} else if !ok {
+		return nil, ErrFragmentSequence
+	}
+
+	if r.buffered+len(f.Payload) > r.maxSize {
+		r.Discard(f.Sender)
+		return nil, ErrReassemblyLimit
+	}
+	p.Payload = append(p.Payload, f.Payload...)
+	r.buffered += len(f.Payload)
+
+	if f.Flags&FlagFragEnd == 0 {
+		return nil, nil
+	}
+	r.buffered -= len(p.Payload)
+	delete(r.partial, f.Sender)
+	return p, nil
+}
+
+// Discard drops message in progress from sender
+func (r *Reassembler) Discard(sender string) {
+	if p, ok := r.partial[sender]; ok {
+		r.buffered -= len(p.Payload)
+		delete(r.partial, sender)
+	}
+}
@@ -0,0 +1,92 @@
+package message
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	f := &Frame{Version: Version, Type: HeaderTypeClientMessage, Recipient: "b", Payload: []byte("ABCDE")}
+	tests := []struct {
+		name      string
+		size      int
+		wantFlags []uint8
+	}{
+		{"fits", 5, []uint8{0}},
+		{"two fragments", 3, []uint8{FlagFragStart, FlagFragEnd}},
+		{"exact fragments", 1, []uint8{FlagFragStart, FlagFragContinue, FlagFragContinue, FlagFragContinue, FlagFragEnd}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Split(f, tt.size)
+			var flags []uint8
+			var payload []byte
+			for _, fr := range got {
+				flags = append(flags, fr.Flags)
+				payload = append(payload, fr.Payload...)
+				if fr.Recipient != f.Recipient || fr.Type != f.Type {
+					t.Errorf("Split() fragment lost routing fields: %v", fr)
+				}
+			}
+			if !reflect.DeepEqual(flags, tt.wantFlags) {
+				t.Errorf("Split() flags = %v, want %v", flags, tt.wantFlags)
+			}
+			if !bytes.Equal(payload, f.Payload) {
+				t.Errorf("Split() payload = %s, want %s", payload, f.Payload)
+			}
+		})
+	}
+}
+
+func TestReassembler_Add(t *testing.T) {
+	r := NewReassembler(4)
+	a := Split(&Frame{Type: HeaderTypeClientMessage, Sender: "a", Payload: []byte("ABC")}, 1)
+	b := Split(&Frame{Type: HeaderTypeClientMessage, Sender: "b", Payload: []byte("XY")}, 1)
+
+	// interleaved senders
+	for _, fr := range []*Frame{a[0], b[0], a[1], b[1]} {
+		got, err := r.Add(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr == b[1] {
+			if got == nil || string(got.Payload) != "XY" || got.IsFragment() {
+				t.Fatalf("Add() got = %v, want XY message", got)
+			}
+			continue
+		}
+		if got != nil {
+			t.Fatalf("Add() returned message before the last fragment: %v", got)
+		}
+	}
+	got, err := r.Add(a[2])
+	if err != nil || got == nil || string(got.Payload) != "ABC" {
+		t.Fatalf("Add() got = %v, %v, want ABC message", got, err)
+	}
+
+	// plain frame passes through
+	plain := &Frame{Sender: "a", Payload: []byte("plain")}
+	if got, _ = r.Add(plain); got != plain {
+		t.Fatalf("Add() got = %v, want plain frame", got)
+	}
+
+	// sequence errors
+	if _, err = r.Add(a[1]); err != ErrFragmentSequence {
+		t.Fatalf("Add() error = %v, want %v", err, ErrFragmentSequence)
+	}
+	_, _ = r.Add(a[0])
+	if _, err = r.Add(a[0]); err != ErrFragmentSequence {
+		t.Fatalf("Add() error = %v, want %v", err, ErrFragmentSequence)
+	}
+
+	// limit
+	big := Split(&Frame{Sender: "c", Payload: []byte("ABCDEFGH")}, 3)
+	_, _ = r.Add(big[0])
+	if _, err = r.Add(big[1]); err != ErrReassemblyLimit {
+		t.Fatalf("Add() error = %v, want %v", err, ErrReassemblyLimit)
+	}
+	if r.buffered != 0 {
+		t.Fatalf("buffered = %d after discard, want 0", r.buffered)
+	}
+}
@@ -0,0 +1,131 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// tokenSeparator separates capabilities and session token in handshake payload
+const tokenSeparator = "\n"
+
+// Hello builds client hello frame with the supported capabilities
+func Hello(caps []string) *Frame {
+	return Resume(caps, "")
+}
+
+// Resume builds client hello frame asking to resume session with the token
+func Resume(caps []string, token string) *Frame {
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeHello,
+		Payload: handshakePayload(caps, token),
+	}
+}
+
+// Welcome builds server reply to hello with the assigned connection ID, the session token,
+// empty if sessions are not resumable, and the agreed capabilities
+func Welcome(connID, token string, caps []string) *Frame {
+	return &Frame{
+		Version:   Version,
+		Type:      HeaderTypeWelcome,
+		Recipient: connID,
+		Payload:   handshakePayload(caps, token),
+	}
+}
+
+// ParseHandshake returns capabilities and session token of hello or welcome frame
+func ParseHandshake(f *Frame) (caps []string, token string) {
+	p := string(f.Payload)
+	if i := strings.Index(p, tokenSeparator); i >= 0 {
+		p, token = p[:i], p[i+len(tokenSeparator):]
+	}
+	return DecodeCapabilities([]byte(p)), token
+}
+
+func handshakePayload(caps []string, token string) []byte {
+	p := EncodeCapabilities(caps)
+	if token == "" {
+		return p
+	}
+	return append(append(p, tokenSeparator...), token...)
+}
+
+// EncodeCapabilities encode capabilities list
+func EncodeCapabilities(caps []string) []byte {
+	return []byte(strings.Join(caps, ","))
+}
+
+// DecodeCapabilities decode capabilities list
+func DecodeCapabilities(p []byte) []string {
+	if len(p) == 0 {
+		return nil
+	}
+	return strings.Split(string(p), ",")
+}
+
+// Negotiate returns capabilities from requested which are supported
+func Negotiate(requested, supported []string) []string {
+	var agreed []string
+	for _, c := range requested {
+		for _, s := range supported {
+			if c == s {
+				agreed = append(agreed, c)
+				break
+			}
+		}
+	}
+	return agreed
+}
+
+// Auth builds client credentials frame sent right after hello to servers requiring authentication
+func Auth(user, password string) *Frame {
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeAuth,
+		Payload: []byte(user + tokenSeparator + password),
+	}
+}
+
+// ParseAuth returns user name and password of HeaderTypeAuth frame
+func ParseAuth(f *Frame) (user, password string, err error) {
+	p := string(f.Payload)
+	i := strings.Index(p, tokenSeparator)
+	if f.Type != HeaderTypeAuth || i < 0 {
+		return "", "", ErrWrongFormat
+	}
+	return p[:i], p[i+len(tokenSeparator):], nil
+}
+
+// ProtocolError error received in HeaderTypeError frame
+type ProtocolError struct {
+	Code uint16
+	Text string
+}
+
+// Error implements error
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol error %d: %s", e.Code, e.Text)
+}
+
+// ErrorFrame builds HeaderTypeError frame
+func ErrorFrame(code uint16, text string) *Frame {
+	payload := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(payload, code)
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeError,
+		Payload: append(payload, text...),
+	}
+}
+
+// ParseError parses HeaderTypeError frame
+func ParseError(f *Frame) (*ProtocolError, error) {
+	if f.Type != HeaderTypeError || len(f.Payload) < 2 {
+		return nil, ErrWrongFormat
+	}
+	return &ProtocolError{
+		Code: binary.BigEndian.Uint16(f.Payload),
+		Text: string(f.Payload[2:]),
+	}, nil
+}
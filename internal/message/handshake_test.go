@@ -0,0 +1,74 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		supported []string
+		want      []string
+	}{
+		{"nothing requested", nil, []string{"a"}, nil},
+		{"nothing supported", []string{"a"}, nil, nil},
+		{"intersection", []string{"a", "b", "c"}, []string{"c", "a"}, []string{"a", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caps := DecodeCapabilities(EncodeCapabilities(tt.requested))
+			if got := Negotiate(caps, tt.supported); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Negotiate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	got, err := ParseError(ErrorFrame(ErrCodeVersion, "bad version"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ProtocolError{Code: ErrCodeVersion, Text: "bad version"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseError() = %v, want %v", got, want)
+	}
+
+	if _, err = ParseError(&Frame{Type: HeaderTypeError, Payload: []byte{1}}); err == nil {
+		t.Error("ParseError() accepted short payload")
+	}
+}
+
+func TestParseHandshake(t *testing.T) {
+	tests := []struct {
+		name      string
+		f         *Frame
+		wantCaps  []string
+		wantToken string
+	}{
+		{"hello", Hello([]string{CapSync, CapChecksum}), []string{CapSync, CapChecksum}, ""},
+		{"resume", Resume([]string{CapSync}, "abc"), []string{CapSync}, "abc"},
+		{"resume without capabilities", Resume(nil, "abc"), nil, "abc"},
+		{"welcome", Welcome("id", "abc", []string{CapChecksum}), []string{CapChecksum}, "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caps, token := ParseHandshake(tt.f)
+			if !reflect.DeepEqual(caps, tt.wantCaps) || token != tt.wantToken {
+				t.Errorf("ParseHandshake() = %v, %q, want %v, %q", caps, token, tt.wantCaps, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestParseAuth(t *testing.T) {
+	user, password, err := ParseAuth(Auth("alice", "pass\nword"))
+	if err != nil || user != "alice" || password != "pass\nword" {
+		t.Errorf("ParseAuth() = %q, %q, %v", user, password, err)
+	}
+	if _, _, err = ParseAuth(&Frame{Type: HeaderTypeAuth, Payload: []byte("alice")}); err == nil {
+		t.Error("ParseAuth() accepted payload without password")
+	}
+}
@@ -3,47 +3,267 @@ package message
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"math"
 )
 
-// Encode encode message
-func Encode(msg string) ([]byte, error) {
-	content := []byte(msg)
-	if len(content) > math.MaxUint16 {
-		return []byte{}, errors.New("message is to big")
+// Version current protocol version
+const Version = 1
+
+// Frame header sizes: version, type, flags and uint16 or uint32 body length
+const (
+	HeaderSize    = 5
+	ExtHeaderSize = 7
+)
+
+// ChecksumSize size of CRC32C trailer of frames with FlagChecksum
+const ChecksumSize = 4
+
+// DefaultMaxSize default max body size accepted by Read
+const DefaultMaxSize = 16 << 20
+
+// MaxIDLen max length of the sender and recipient fields
+const MaxIDLen = math.MaxUint8
+
+// Errors returned by Encode, Decode and Read
+var (
+	ErrWrongFormat = errors.New("wrong message format")
+	ErrTooBig      = errors.New("message is too big")
+	ErrIDTooLong   = errors.New("sender or recipient is too long")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError frame checksum mismatch, the frame is consumed entirely so the stream stays in sync
+type ChecksumError struct {
+	Expected uint32
+	Actual   uint32
+}
+
+// Error implements error
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("frame checksum mismatch: expected %08x, actual %08x", e.Expected, e.Actual)
+}
+
+// Frame chat protocol frame
+//
+// Wire layout:
+//
+//	version(1) type(1) flags(1) body length(2, or 4 with FlagExtLength)
+//	sender length(1) sender recipient length(1) recipient payload
+//	CRC32C of header and body(4, with FlagChecksum only)
+type Frame struct {
+	Version   uint8
+	Type      uint8
+	Flags     uint8
+	Sender    string
+	Recipient string
+	Payload   []byte
+}
+
+// Encode encode frame, bodies longer than math.MaxUint16 get FlagExtLength.
+// Frames with FlagChecksum get CRC32C trailer
+func Encode(f *Frame) ([]byte, error) {
+	return AppendEncode(nil, f)
+}
+
+// AppendEncode appends encoded frame to dst and returns the extended buffer
+func AppendEncode(dst []byte, f *Frame) ([]byte, error) {
+	if len(f.Sender) > MaxIDLen || len(f.Recipient) > MaxIDLen {
+		return nil, ErrIDTooLong
+	}
+	bodyLen := 2 + len(f.Sender) + len(f.Recipient) + len(f.Payload)
+	if uint64(bodyLen) > math.MaxUint32 {
+		return nil, ErrTooBig
+	}
+
+	flags := f.Flags &^ FlagExtLength
+	if bodyLen > math.MaxUint16 {
+		flags |= FlagExtLength
+	}
+	hLen := headerLen(flags)
+	start := len(dst)
+	res := grow(dst, start+hLen+bodyLen+ChecksumSize)[:start+hLen]
+	res[start] = f.Version
+	res[start+1] = f.Type
+	res[start+2] = flags
+	if flags&FlagExtLength != 0 {
+		binary.BigEndian.PutUint32(res[start+3:], uint32(bodyLen))
+	} else {
+		binary.BigEndian.PutUint16(res[start+3:], uint16(bodyLen))
+	}
+	res = append(res, uint8(len(f.Sender)))
+	res = append(res, f.Sender...)
+	res = append(res, uint8(len(f.Recipient)))
+	res = append(res, f.Recipient...)
+	res = append(res, f.Payload...)
+	if flags&FlagChecksum != 0 {
+		sum := crc32.Checksum(res[start:], castagnoli)
+		res = append(res, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(res[len(res)-ChecksumSize:], sum)
 	}
-	res := make([]byte, 2, len(content)+2)
-	binary.BigEndian.PutUint16(res, uint16(len(content)))
-	res = append(res, content...)
 	return res, nil
 }
 
-// Decode decode message
-func Decode(data []byte) (string, error) {
-	formatError := errors.New("wrong message format")
-	if cap(data) < 2 {
-		return "", formatError
+// Decode decode frame
+func Decode(data []byte) (*Frame, error) {
+	f := &Frame{}
+	if err := DecodeView(data, f); err != nil {
+		return nil, err
+	}
+	f.Payload = append([]byte{}, f.Payload...)
+	return f, nil
+}
+
+// DecodeView decodes frame into f without copying the payload, f.Payload refers to data.
+// Sender and recipient are copied into new strings, DecodeViewIntern avoids these allocations
+func DecodeView(data []byte, f *Frame) error {
+	return decode(data, f, func(b []byte) string {
+		return string(b)
+	})
+}
+
+// DecodeViewIntern decodes frame into f like DecodeView, but sender and recipient strings are made by intern,
+// so it may return cached strings for repeated IDs
+func DecodeViewIntern(data []byte, f *Frame, intern func([]byte) string) error {
+	return decode(data, f, intern)
+}
+
+func decode(data []byte, f *Frame, id func([]byte) string) error {
+	if len(data) < HeaderSize {
+		return ErrWrongFormat
+	}
+	hLen := headerLen(data[2])
+	if len(data) < hLen {
+		return ErrWrongFormat
+	}
+	end := len(data)
+	if data[2]&FlagChecksum != 0 {
+		end -= ChecksumSize
+	}
+	if end < hLen || bodyLen(data[:hLen]) != uint64(end-hLen) {
+		return ErrWrongFormat
 	}
-	cLen := binary.BigEndian.Uint16(data[0:2])
-	if cLen != uint16(len(data[2:])) {
-		return "", formatError
+	if end < len(data) {
+		expected := binary.BigEndian.Uint32(data[end:])
+		if actual := crc32.Checksum(data[:end], castagnoli); actual != expected {
+			return &ChecksumError{Expected: expected, Actual: actual}
+		}
 	}
 
-	return string(data[2:]), nil
+	body := data[hLen:end]
+	sender, body, ok := readID(body)
+	if !ok {
+		return ErrWrongFormat
+	}
+	recipient, body, ok := readID(body)
+	if !ok {
+		return ErrWrongFormat
+	}
+	f.Version = data[0]
+	f.Type = data[1]
+	f.Flags = data[2] &^ wireFlags
+	f.Sender = id(sender)
+	f.Recipient = id(recipient)
+	f.Payload = body
+	return nil
+}
+
+// Read reads frame from io.Reader, body size is limited by DefaultMaxSize
+func Read(r io.Reader) (*Frame, error) {
+	return ReadMax(r, DefaultMaxSize)
 }
 
-// Read reads message from io.Reader
-func Read(r io.Reader) ([]byte, error) {
-	lb := make([]byte, 2)
-	_, err := io.ReadFull(r, lb)
+// ReadMax reads frame from io.Reader, frames with body longer than maxSize are rejected with ErrTooBig
+// before the body is allocated. Compressed payload is inflated up to maxSize
+func ReadMax(r io.Reader, maxSize int) (*Frame, error) {
+	data, err := readRaw(r, nil, maxSize)
 	if err != nil {
 		return nil, err
 	}
-	content := make([]byte, binary.BigEndian.Uint16(lb))
-	_, err = io.ReadFull(r, content)
-	if err != nil {
+	f := &Frame{}
+	if err = DecodeView(data, f); err != nil {
 		return nil, err
 	}
-	return append(lb, content...), nil
+	return Decompress(f, maxSize)
+}
+
+// readRaw reads encoded frame into buf, on error it returns the part of frame read before the error
+func readRaw(r io.Reader, buf []byte, maxSize int) ([]byte, error) {
+	buf = grow(buf[:0], ExtHeaderSize)
+	n, err := io.ReadFull(r, buf[:HeaderSize])
+	if err != nil {
+		return buf[:n], err
+	}
+	hLen := headerLen(buf[2])
+	if hLen > HeaderSize {
+		if n, err = io.ReadFull(r, buf[HeaderSize:hLen]); err != nil {
+			return buf[:HeaderSize+n], noEOF(err)
+		}
+	}
+	if bodyLen(buf[:hLen]) > uint64(maxSize) {
+		return buf[:hLen], ErrTooBig
+	}
+	size := frameSize(buf[:hLen])
+	buf = grow(buf[:hLen], size)
+	n, err = io.ReadFull(r, buf[hLen:])
+	if err != nil {
+		return buf[:hLen+n], noEOF(err)
+	}
+	return buf, nil
+}
+
+// grow returns buffer of length n with the content of b
+func grow(b []byte, n int) []byte {
+	if cap(b) >= n {
+		return b[:n]
+	}
+	nb := make([]byte, n)
+	copy(nb, b)
+	return nb
+}
+
+// frameSize returns encoded frame size by its header
+func frameSize(header []byte) int {
+	size := len(header) + int(bodyLen(header))
+	if header[2]&FlagChecksum != 0 {
+		size += ChecksumSize
+	}
+	return size
+}
+
+func headerLen(flags uint8) int {
+	if flags&FlagExtLength != 0 {
+		return ExtHeaderSize
+	}
+	return HeaderSize
+}
+
+// bodyLen reads body length from the frame header
+func bodyLen(header []byte) uint64 {
+	if len(header) == ExtHeaderSize {
+		return uint64(binary.BigEndian.Uint32(header[3:ExtHeaderSize]))
+	}
+	return uint64(binary.BigEndian.Uint16(header[3:HeaderSize]))
+}
+
+// noEOF turns io.EOF in the middle of a frame into io.ErrUnexpectedEOF
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func readID(body []byte) (id, rest []byte, ok bool) {
+	if len(body) < 1 {
+		return nil, nil, false
+	}
+	l := int(body[0])
+	if len(body) < 1+l {
+		return nil, nil, false
+	}
+	return body[1 : 1+l], body[1+l:], true
 }
@@ -2,6 +2,7 @@ package message
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"math"
 	"math/rand"
@@ -11,9 +12,10 @@ import (
 )
 
 func TestEncode(t *testing.T) {
-	maxLenString := randString(math.MaxUint16)
+	maxLenString := randString(math.MaxUint16 - 2)
+	extLenString := randString(math.MaxUint16 - 1)
 	type args struct {
-		msg string
+		f *Frame
 	}
 	tests := []struct {
 		name    string
@@ -23,32 +25,44 @@ func TestEncode(t *testing.T) {
 	}{
 		{
 			name:    "case1",
-			args:    args{msg: "AB"},
-			want:    []byte{0x00, 0x02, 0x41, 0x42},
+			args:    args{f: &Frame{Version: Version, Type: HeaderTypeClientMessage, Payload: []byte("AB")}},
+			want:    []byte{Version, HeaderTypeClientMessage, 0, 0x00, 0x04, 0, 0, 0x41, 0x42},
 			wantErr: false,
 		},
 		{
-			name:    "case2",
-			args:    args{msg: "ABA"},
-			want:    []byte{0x00, 0x03, 0x41, 0x42, 0x41},
+			name: "sender and recipient",
+			args: args{f: &Frame{
+				Version:   Version,
+				Type:      HeaderTypeClientMessage,
+				Sender:    "a",
+				Recipient: "bc",
+				Payload:   []byte("ABA"),
+			}},
+			want:    []byte{Version, HeaderTypeClientMessage, 0, 0x00, 0x08, 1, 'a', 2, 'b', 'c', 0x41, 0x42, 0x41},
 			wantErr: false,
 		},
 		{
-			name:    "string max len",
-			args:    args{msg: maxLenString},
-			want:    append([]byte{0xff, 0xff}, []byte(maxLenString)...),
+			name:    "payload max len",
+			args:    args{f: &Frame{Payload: []byte(maxLenString)}},
+			want:    append([]byte{0, 0, 0, 0xff, 0xff, 0, 0}, []byte(maxLenString)...),
 			wantErr: false,
 		},
 		{
-			name:    "too long string",
-			args:    args{msg: randString(math.MaxUint16 + 1)},
-			want:    []byte{},
+			name:    "extended length",
+			args:    args{f: &Frame{Payload: []byte(extLenString)}},
+			want:    append([]byte{0, 0, FlagExtLength, 0, 0x01, 0x00, 0x00, 0, 0}, []byte(extLenString)...),
+			wantErr: false,
+		},
+		{
+			name:    "too long sender",
+			args:    args{f: &Frame{Sender: randString(math.MaxUint8 + 1)}},
+			want:    nil,
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := Encode(tt.args.msg)
+			got, err := Encode(tt.args.f)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Encode() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -67,15 +81,39 @@ func TestDecode(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
-		want    string
+		want    *Frame
 		wantErr bool
 	}{
-		{"case 1", args{data: []byte{0x00, 0x02, 0x41, 0x42}}, "AB", false},
-		{"case 2", args{data: []byte{0x00, 0x03, 0x41, 0x42, 0x41}}, "ABA", false},
-		{"wrong length", args{data: []byte{0x00, 0x02, 0x41, 0x42, 0x41, 0x42}}, "", true},
-		{"empty content message", args{data: []byte{0x00, 0x00}}, "", false},
-		{"empty data", args{data: []byte{}}, "", true},
-		{"one byte", args{data: []byte{0x03}}, "", true},
+		{
+			"case 1",
+			args{data: []byte{Version, HeaderTypeClientMessage, 0, 0x00, 0x04, 0, 0, 0x41, 0x42}},
+			&Frame{Version: Version, Type: HeaderTypeClientMessage, Payload: []byte("AB")},
+			false,
+		},
+		{
+			"sender and recipient",
+			args{data: []byte{Version, HeaderTypeNewClient, 0, 0x00, 0x05, 1, 'a', 1, 'b', 0x41}},
+			&Frame{Version: Version, Type: HeaderTypeNewClient, Sender: "a", Recipient: "b", Payload: []byte("A")},
+			false,
+		},
+		{
+			"empty payload",
+			args{data: []byte{Version, HeaderTypeNewClient, 0, 0x00, 0x03, 1, 'a', 0}},
+			&Frame{Version: Version, Type: HeaderTypeNewClient, Sender: "a", Payload: []byte{}},
+			false,
+		},
+		{
+			"extended length",
+			args{data: []byte{Version, HeaderTypeClientMessage, FlagExtLength, 0, 0, 0, 0x03, 0, 0, 0x41}},
+			&Frame{Version: Version, Type: HeaderTypeClientMessage, Payload: []byte("A")},
+			false,
+		},
+		{"wrong length", args{data: []byte{Version, 0, 0, 0x00, 0x02, 0, 0, 0x41, 0x42}}, nil, true},
+		{"short extended header", args{data: []byte{Version, 0, FlagExtLength, 0, 0, 0}}, nil, true},
+		{"sender overflows body", args{data: []byte{Version, 0, 0, 0x00, 0x02, 5, 0}}, nil, true},
+		{"missing recipient", args{data: []byte{Version, 0, 0, 0x00, 0x01, 0}}, nil, true},
+		{"empty data", args{data: []byte{}}, nil, true},
+		{"short header", args{data: []byte{Version, 0, 0}}, nil, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -84,7 +122,7 @@ func TestDecode(t *testing.T) {
 				t.Errorf("Decode() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if got != tt.want {
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Decode() got = %v, want %v", got, tt.want)
 			}
 		})
@@ -109,18 +147,24 @@ func TestRead(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
-		want    []byte
+		want    *Frame
 		wantErr bool
 	}{
 		{
 			"message ok",
-			args{r: bytes.NewReader([]byte{0, 1, 'A'})},
-			[]byte{0, 1, 'A'},
+			args{r: bytes.NewReader([]byte{Version, HeaderTypeClientMessage, 0, 0, 3, 0, 0, 'A'})},
+			&Frame{Version: Version, Type: HeaderTypeClientMessage, Payload: []byte("A")},
 			false,
 		},
 		{
 			"wrong msg format",
-			args{r: bytes.NewReader([]byte{0, 4, 'A'})},
+			args{r: bytes.NewReader([]byte{Version, HeaderTypeClientMessage, 0, 0, 4, 0, 0, 'A'})},
+			nil,
+			true,
+		},
+		{
+			"short header",
+			args{r: bytes.NewReader([]byte{Version, HeaderTypeClientMessage})},
 			nil,
 			true,
 		},
@@ -138,3 +182,63 @@ func TestRead(t *testing.T) {
 		})
 	}
 }
+
+func TestReadMax(t *testing.T) {
+	big, _ := Encode(&Frame{Version: Version, Payload: bytes.Repeat([]byte{'A'}, math.MaxUint16+1)})
+	tests := []struct {
+		name    string
+		data    []byte
+		maxSize int
+		wantErr error
+	}{
+		{"short frame", []byte{Version, HeaderTypeClientMessage, 0, 0, 3, 0, 0, 'A'}, 3, nil},
+		{"short frame over limit", []byte{Version, HeaderTypeClientMessage, 0, 0, 3, 0, 0, 'A'}, 2, ErrTooBig},
+		{"extended frame", big, DefaultMaxSize, nil},
+		{"extended frame over limit", big, math.MaxUint16, ErrTooBig},
+		{
+			"huge declared length",
+			[]byte{Version, HeaderTypeClientMessage, FlagExtLength, 0xff, 0xff, 0xff, 0xff},
+			DefaultMaxSize,
+			ErrTooBig,
+		},
+		{"truncated extended header", []byte{Version, HeaderTypeClientMessage, FlagExtLength, 0}, DefaultMaxSize, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadMax(bytes.NewReader(tt.data), tt.maxSize)
+			if err != tt.wantErr {
+				t.Errorf("ReadMax() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRead_Checksum(t *testing.T) {
+	f := &Frame{Version: Version, Type: HeaderTypeClientMessage, Flags: FlagChecksum, Sender: "a", Payload: []byte("AB")}
+	data, err := Encode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != HeaderSize+5+ChecksumSize {
+		t.Fatalf("Encode() len = %d, want checksum trailer", len(data))
+	}
+
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-ChecksumSize-1] ^= 0xff
+	r := bytes.NewReader(append(corrupted, data...))
+
+	_, err = Read(r)
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) {
+		t.Fatalf("Read() error = %v, want ChecksumError", err)
+	}
+
+	got, err := Read(r)
+	if err != nil {
+		t.Fatalf("Read() after corrupted frame error = %v", err)
+	}
+	want := &Frame{Version: Version, Type: HeaderTypeClientMessage, Sender: "a", Payload: []byte("AB")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Read() got = %v, want %v", got, want)
+	}
+}
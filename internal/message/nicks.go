@@ -0,0 +1,54 @@
+package message
+
+import "strings"
+
+// MaxNick max length of nickname
+const MaxNick = 32
+
+// ValidNick reports whether nick may be used as nickname, it starts with a letter
+// and has letters, digits, '_', '-' and '.' only
+func ValidNick(nick string) bool {
+	if nick == "" || len(nick) > MaxNick {
+		return false
+	}
+	for i, r := range nick {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && (r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SetNick builds request to change nickname, server sends it to clients sharing a room as nick-changed event
+func SetNick(nick string) *Frame {
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeSetNick,
+		Payload: []byte(nick),
+	}
+}
+
+// Nick returns nickname of the sender of new-client, clients-list, disconnect or nick-changed frame,
+// empty if the client has no nickname
+func Nick(f *Frame) string {
+	switch f.Type {
+	case HeaderTypeNewClient, HeaderTypeClientList:
+		p := string(f.Payload)
+		if i := strings.Index(p, roomSeparator); i >= 0 {
+			return p[i+len(roomSeparator):]
+		}
+		return ""
+	case HeaderTypeDisconnectClient:
+		if len(f.Payload) < 2 {
+			return ""
+		}
+		return string(f.Payload[1:])
+	case HeaderTypeSetNick:
+		return string(f.Payload)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,54 @@
+package message
+
+import "testing"
+
+func TestValidNick(t *testing.T) {
+	tests := []struct {
+		nick string
+		want bool
+	}{
+		{"alice", true},
+		{"Bob_2.0", true},
+		{"", false},
+		{"2pac", false},
+		{"_alice", false},
+		{"two words", false},
+		{"#room", false},
+		{"@alice", false},
+		{"ünicode", false},
+		{string(make([]byte, MaxNick+1)), false},
+	}
+	for _, tt := range tests {
+		if got := ValidNick(tt.nick); got != tt.want {
+			t.Errorf("ValidNick(%q) = %v, want %v", tt.nick, got, tt.want)
+		}
+	}
+}
+
+func TestNick(t *testing.T) {
+	tests := []struct {
+		name string
+		f    *Frame
+		want string
+	}{
+		{"joined", Joined("id", "alice", "dev"), "alice"},
+		{"joined without nick", Joined("id", "", "dev"), ""},
+		{"member", Member("id", "alice", "dev", "other"), "alice"},
+		{"disconnect", DisconnectClient("id", "alice", ReasonLeft), "alice"},
+		{"disconnect without nick", DisconnectClient("id", "", ReasonLeft), ""},
+		{"set nick", SetNick("alice"), "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Nick(tt.f); got != tt.want {
+				t.Errorf("Nick() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if room := Room(Joined("id", "alice", "dev")); room != "dev" {
+		t.Errorf("Room() = %q, want %q", room, "dev")
+	}
+	if reason := DisconnectReason(DisconnectClient("id", "alice", ReasonIdle)); reason != ReasonIdle {
+		t.Errorf("DisconnectReason() = %d, want %d", reason, ReasonIdle)
+	}
+}
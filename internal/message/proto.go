@@ -6,12 +6,83 @@ const (
 	HeaderTypeClientList
 	HeaderTypeDisconnectClient
 	HeaderTypeClientMessage
+	HeaderTypeHello
+	HeaderTypeWelcome
+	HeaderTypeError
+	HeaderTypePing
+	HeaderTypePong
+	HeaderTypeGoodbye
+	HeaderTypeShutdown
+	HeaderTypeJoinRoom
+	HeaderTypeLeaveRoom
+	HeaderTypeInvite
+	HeaderTypeListRooms
+	HeaderTypeRoomList
+	HeaderTypeSetTopic
+	HeaderTypeSetNick
+	HeaderTypeAuth
 )
 
-// Header message prefix
+// Error codes of HeaderTypeError frames
 const (
-	NewClientHeaderPrefix        = "[new-client]"
-	ClientsListHeaderPrefix      = "[clients-list]"
-	ClientDisconnectHeaderPrefix = "[client-disconnect]"
-	ClientMessageHeaderPrefix    = "[client-message]"
+	ErrCodeVersion = iota + 1
+	ErrCodeHandshake
+	ErrCodeRoomName
+	ErrCodeNotMember
+	ErrCodeRoomUnavailable
+	ErrCodeWrongPassword
+	ErrCodeNotOwner
+	ErrCodeNoClient
+	ErrCodeTopic
+	ErrCodeNickInvalid
+	ErrCodeNickTaken
+	ErrCodeNickReserved
+	ErrCodeAuth
+	ErrCodeNickLocked
+)
+
+// Disconnect reasons sent in payload of HeaderTypeDisconnectClient and HeaderTypeGoodbye frames
+const (
+	ReasonLeft = iota + 1
+	ReasonError
+	ReasonCorrupted
+	ReasonSlowConsumer
+	ReasonHeartbeat
+	ReasonIdle
+	ReasonSessionExpired
+)
+
+// Frame flags
+const (
+	// FlagExtLength body length is uint32 instead of uint16
+	FlagExtLength = 1 << iota
+	// FlagFragStart first fragment of a message
+	FlagFragStart
+	// FlagFragContinue middle fragment of a message
+	FlagFragContinue
+	// FlagFragEnd last fragment of a message
+	FlagFragEnd
+	// FlagCompressed payload is compressed with DEFLATE
+	FlagCompressed
+	// FlagChecksum frame is followed by CRC32C trailer
+	FlagChecksum
+)
+
+// allFlags all known flags
+const allFlags = FlagExtLength | FlagFragStart | FlagFragContinue | FlagFragEnd | FlagCompressed | FlagChecksum
+
+// wireFlags flags describing frame encoding only, they are set by Encode and dropped by Decode
+const wireFlags = FlagExtLength | FlagChecksum
+
+// fragmentFlags all fragment flags
+const fragmentFlags = FlagFragStart | FlagFragContinue | FlagFragEnd
+
+// Capabilities negotiated in handshake
+const (
+	// CapCompression peer accepts compressed frames
+	CapCompression = "compression"
+	// CapChecksum peer accepts frames with checksum trailer
+	CapChecksum = "checksum"
+	// CapSync every frame after handshake is preceded by Magic marker
+	CapSync = "sync"
 )
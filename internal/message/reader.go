@@ -0,0 +1,222 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync/atomic"
+)
+
+// Magic start marker of every frame in sync mode
+var Magic = [4]byte{0xc4, 0x7a, 0xf5, 0x1e}
+
+// maxInterned max count of sender and recipient strings cached by Reader
+const maxInterned = 1024
+
+// Reader reads frames from stream reusing pooled buffers. In sync mode every frame must be preceded by Magic,
+// so after corrupted data the reader scans forward to the next valid frame
+type Reader struct {
+	skipped uint64
+	r       *bufio.Reader
+	maxSize int
+	sync    bool
+	// OnSkip is called with count of bytes skipped to find the next frame in sync mode
+	OnSkip func(n int)
+
+	buf      *[]byte
+	frame    Frame
+	ids      map[string]string
+	src      bytes.Reader
+	inflater io.ReadCloser
+	limited  io.LimitedReader
+	inflated bytes.Buffer
+	// partial frame cut by the last read error
+	partial []byte
+}
+
+// NewReader creates new Reader, frames with body longer than maxSize are rejected
+func NewReader(r io.Reader, maxSize int) *Reader {
+	return &Reader{
+		r:       bufio.NewReader(r),
+		maxSize: maxSize,
+		ids:     map[string]string{},
+	}
+}
+
+// SetSync turns sync mode on or off
+func (r *Reader) SetSync(sync bool) {
+	r.sync = sync
+}
+
+// Skipped returns total count of bytes skipped in sync mode
+func (r *Reader) Skipped() uint64 {
+	return atomic.LoadUint64(&r.skipped)
+}
+
+// Release returns reader buffer to the pool, reader must not be used after release
+func (r *Reader) Release() {
+	if r.buf != nil {
+		putBuffer(r.buf)
+		r.buf = nil
+	}
+}
+
+// Unread returns data read from stream but not returned as frame yet, such as a frame cut by read deadline.
+// Reading it before the rest of stream gives the same frames
+func (r *Reader) Unread() []byte {
+	var data []byte
+	if len(r.partial) > 0 {
+		if r.sync {
+			data = append(data, Magic[:]...)
+		}
+		data = append(data, r.partial...)
+	}
+	buffered, _ := r.r.Peek(r.r.Buffered())
+	return append(data, buffered...)
+}
+
+// Read reads next frame. In sync mode malformed frames are skipped,
+// ChecksumError is still returned so caller can account corrupted frames
+func (r *Reader) Read() (*Frame, error) {
+	v, err := r.ReadView()
+	if err != nil {
+		return nil, err
+	}
+	f := *v
+	f.Payload = append([]byte{}, v.Payload...)
+	return &f, nil
+}
+
+// ReadView reads next frame like Read without allocations,
+// the returned frame and its payload are valid until the next call only
+func (r *Reader) ReadView() (*Frame, error) {
+	// buffers grown by a large frame are dropped, so connection does not keep them for small frames
+	if r.buf == nil || cap(*r.buf) > maxPooledBuffer {
+		r.buf = getBuffer()
+	}
+	if r.inflated.Cap() > maxPooledBuffer {
+		r.inflated = bytes.Buffer{}
+	}
+	r.partial = r.partial[:0]
+	if !r.sync {
+		data, err := r.readRaw()
+		if err != nil {
+			return nil, err
+		}
+		if err = r.view(data); err != nil {
+			return nil, err
+		}
+		return &r.frame, nil
+	}
+
+	skipped := 0
+	defer func() {
+		if skipped == 0 {
+			return
+		}
+		atomic.AddUint64(&r.skipped, uint64(skipped))
+		if r.OnSkip != nil {
+			r.OnSkip(skipped)
+		}
+	}()
+
+	for {
+		b, err := r.r.Peek(len(Magic) + ExtHeaderSize)
+		if err != nil {
+			if err == io.EOF && len(b) > 0 {
+				skipped += len(b)
+				_, _ = r.r.Discard(len(b))
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if !bytes.Equal(b[:len(Magic)], Magic[:]) || !r.validHeader(b[len(Magic):]) {
+			n := len(b)
+			if i := bytes.IndexByte(b[1:], Magic[0]); i >= 0 {
+				n = 1 + i
+			}
+			skipped += n
+			_, _ = r.r.Discard(n)
+			continue
+		}
+
+		_, _ = r.r.Discard(len(Magic))
+		data, err := r.readRaw()
+		if err != nil {
+			return nil, err
+		}
+		err = r.view(data)
+		if err == ErrWrongFormat {
+			skipped += len(Magic) + len(data)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &r.frame, nil
+	}
+}
+
+func (r *Reader) readRaw() ([]byte, error) {
+	data, err := readRaw(r.r, *r.buf, r.maxSize)
+	if err != nil {
+		r.partial = append(r.partial[:0], data...)
+		return nil, err
+	}
+	*r.buf = data[:0]
+	return data, nil
+}
+
+// view decodes data into the reused frame and inflates compressed payload into the reused buffer
+func (r *Reader) view(data []byte) error {
+	if err := decode(data, &r.frame, r.intern); err != nil {
+		return err
+	}
+	if r.frame.Flags&FlagCompressed == 0 {
+		return nil
+	}
+
+	r.src.Reset(r.frame.Payload)
+	if r.inflater == nil {
+		r.inflater = flate.NewReader(&r.src)
+	} else if err := r.inflater.(flate.Resetter).Reset(&r.src, nil); err != nil {
+		return ErrWrongFormat
+	}
+	r.limited = io.LimitedReader{R: r.inflater, N: int64(r.maxSize) + 1}
+	r.inflated.Reset()
+	if _, err := r.inflated.ReadFrom(&r.limited); err != nil {
+		return ErrWrongFormat
+	}
+	if r.inflated.Len() > r.maxSize {
+		return ErrTooBig
+	}
+	r.frame.Flags &^= FlagCompressed
+	r.frame.Payload = r.inflated.Bytes()
+	return nil
+}
+
+// intern returns cached string for sender or recipient, so repeated IDs are not allocated
+func (r *Reader) intern(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	if s, ok := r.ids[string(b)]; ok {
+		return s
+	}
+	if len(r.ids) >= maxInterned {
+		r.ids = map[string]string{}
+	}
+	s := string(b)
+	r.ids[s] = s
+	return s
+}
+
+// validHeader checks header of the frame candidate in sync mode
+func (r *Reader) validHeader(h []byte) bool {
+	if h[0] != Version || h[2]&^allFlags != 0 {
+		return false
+	}
+	n := bodyLen(h[:headerLen(h[2])])
+	return n >= 2 && n <= uint64(r.maxSize)
+}
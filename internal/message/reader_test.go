@@ -0,0 +1,181 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func syncFrame(t *testing.T, f *Frame) []byte {
+	data, err := Encode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(Magic[:], data...)
+}
+
+func TestReader_Sync(t *testing.T) {
+	first := &Frame{Version: Version, Type: HeaderTypeClientMessage, Payload: []byte("first")}
+	second := &Frame{Version: Version, Type: HeaderTypeClientMessage, Payload: []byte("second")}
+
+	garbage := []byte{0x01, Magic[0], 0x02, 0x03}
+	badVersion := syncFrame(t, &Frame{Version: Version + 1, Payload: []byte("x")})
+	// valid header with broken sender length inside the body
+	badBody := append(Magic[:], Version, HeaderTypeClientMessage, 0, 0, 2, 5, 0)
+
+	var stream []byte
+	stream = append(stream, garbage...)
+	stream = append(stream, syncFrame(t, first)...)
+	stream = append(stream, badVersion...)
+	stream = append(stream, badBody...)
+	stream = append(stream, syncFrame(t, second)...)
+
+	var reported int
+	r := NewReader(bytes.NewReader(stream), DefaultMaxSize)
+	r.SetSync(true)
+	r.OnSkip = func(n int) {
+		reported += n
+	}
+
+	for _, want := range []*Frame{first, second} {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Read() got = %v, want %v", got, want)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("Read() error = %v, want EOF", err)
+	}
+
+	wantSkipped := len(garbage) + len(badVersion) + len(badBody)
+	if r.Skipped() != uint64(wantSkipped) || reported != wantSkipped {
+		t.Fatalf("skipped = %d, reported = %d, want %d", r.Skipped(), reported, wantSkipped)
+	}
+}
+
+func TestReader_NoSync(t *testing.T) {
+	f := &Frame{Version: Version, Type: HeaderTypeClientMessage, Payload: []byte("A")}
+	data, _ := Encode(f)
+	r := NewReader(bytes.NewReader(append([]byte{0xff}, data...)), DefaultMaxSize)
+	if _, err := r.Read(); err == nil {
+		t.Fatal("Read() skipped garbage without sync mode")
+	}
+}
+
+func TestWriter_Reader(t *testing.T) {
+	frames := []*Frame{
+		{Version: Version, Type: HeaderTypeClientMessage, Sender: "a", Payload: []byte("short")},
+		{Version: Version, Type: HeaderTypeClientMessage, Sender: "a", Payload: bytes.Repeat([]byte("long "), 1000)},
+		{Version: Version, Type: HeaderTypeNewClient, Sender: "b", Payload: []byte{}},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetSync(true)
+	w.SetChecksum(true)
+	w.SetCompression(true, DefaultCompressThreshold)
+	for _, f := range frames {
+		if err := w.Write(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.Len() > 1000 {
+		t.Fatalf("long payload is not compressed, stream len = %d", buf.Len())
+	}
+
+	r := NewReader(&buf, DefaultMaxSize)
+	r.SetSync(true)
+	defer r.Release()
+	for _, want := range frames {
+		got, err := r.ReadView()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("ReadView() got = %v, want %v", got, want)
+		}
+	}
+	if r.Skipped() != 0 {
+		t.Fatalf("skipped = %d, want 0", r.Skipped())
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestReader_Unread(t *testing.T) {
+	first := &Frame{Version: Version, Type: HeaderTypeClientMessage, Payload: []byte("first")}
+	second := &Frame{Version: Version, Type: HeaderTypeClientMessage, Sender: "a", Payload: []byte("second")}
+	for _, sync := range []bool{false, true} {
+		var stream []byte
+		for _, f := range []*Frame{first, second} {
+			data := syncFrame(t, f)
+			if !sync {
+				data = data[len(Magic):]
+			}
+			stream = append(stream, data...)
+		}
+		cut := len(stream) - 3
+		errDeadline := errors.New("deadline")
+
+		r := NewReader(io.MultiReader(bytes.NewReader(stream[:cut]), errReader{errDeadline}), DefaultMaxSize)
+		r.SetSync(sync)
+		if got, err := r.Read(); err != nil || !reflect.DeepEqual(got, first) {
+			t.Fatalf("Read() = %v, %v, want %v", got, err, first)
+		}
+		if _, err := r.Read(); err != errDeadline {
+			t.Fatalf("Read() error = %v, want %v", err, errDeadline)
+		}
+
+		resumed := NewReader(io.MultiReader(bytes.NewReader(r.Unread()), bytes.NewReader(stream[cut:])), DefaultMaxSize)
+		resumed.SetSync(sync)
+		if got, err := resumed.Read(); err != nil || !reflect.DeepEqual(got, second) {
+			t.Fatalf("sync %v: resumed Read() = %v, %v, want %v", sync, got, err, second)
+		}
+	}
+}
+
+func TestReader_LargeFrameBuffers(t *testing.T) {
+	large := &Frame{Version: Version, Type: HeaderTypeClientMessage, Payload: bytes.Repeat([]byte("x"), 1<<20)}
+	compressed, err := Compress(large, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := &Frame{Version: Version, Type: HeaderTypeClientMessage, Payload: []byte("small")}
+	var stream []byte
+	for _, f := range []*Frame{large, small, compressed, small} {
+		data, encodeErr := Encode(f)
+		if encodeErr != nil {
+			t.Fatal(encodeErr)
+		}
+		stream = append(stream, data...)
+	}
+
+	r := NewReader(bytes.NewReader(stream), DefaultMaxSize)
+	defer r.Release()
+	for i := 0; i < 4; i++ {
+		f, readErr := r.ReadView()
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if i%2 == 0 {
+			if len(f.Payload) != len(large.Payload) {
+				t.Fatalf("frame %d payload = %d bytes, want %d", i, len(f.Payload), len(large.Payload))
+			}
+			continue
+		}
+		if cap(*r.buf) > maxPooledBuffer || r.inflated.Cap() > maxPooledBuffer {
+			t.Fatalf("after frame %d reader keeps buffers of %d and %d bytes", i, cap(*r.buf), r.inflated.Cap())
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package message
+
+import (
+	"encoding/binary"
+	"strings"
+	"unicode"
+)
+
+// RoomPrefix recipient of a room message is the room name with this prefix
+const RoomPrefix = "#"
+
+// MaxRoomName max length of room name
+const MaxRoomName = 64
+
+// MaxTopic max length of room topic
+const MaxTopic = 256
+
+// Room visibility in room directory
+const (
+	// VisibilityPublic anyone may join
+	VisibilityPublic = iota
+	// VisibilityPassword anyone knowing password may join, room is listed to its members only
+	VisibilityPassword
+	// VisibilityPrivate only invited clients may join, room is listed to its members only
+	VisibilityPrivate
+)
+
+var visibilityText = map[uint8]string{
+	VisibilityPublic:   "public",
+	VisibilityPassword: "password",
+	VisibilityPrivate:  "private",
+}
+
+// VisibilityText returns human readable room visibility
+func VisibilityText(visibility uint8) string {
+	if text, ok := visibilityText[visibility]; ok {
+		return text
+	}
+	return "unknown"
+}
+
+// ValidRoomName reports whether name may be used as room name, it has no spaces, commas and control characters
+func ValidRoomName(name string) bool {
+	if name == "" || len(name) > MaxRoomName {
+		return false
+	}
+	if strings.ContainsAny(name, RoomPrefix+" ,") {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// RoomRecipient returns recipient addressing messages to the room
+func RoomRecipient(name string) string {
+	return RoomPrefix + name
+}
+
+// RoomName returns room name addressed by recipient, ok is false for client recipients
+func RoomName(recipient string) (name string, ok bool) {
+	if !strings.HasPrefix(recipient, RoomPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(recipient, RoomPrefix), true
+}
+
+// roomSeparator separates room name and room options in join request
+const roomSeparator = "\n"
+
+// roomPrivate mode of private room in join request
+const roomPrivate = "private"
+
+// RoomOptions settings of room created by join request, they are ignored when room exists
+type RoomOptions struct {
+	// Private only the owner and invited clients may join, other clients do not see the room
+	Private bool
+	// Password required to join, invited clients join without it
+	Password string
+}
+
+// JoinRoom builds request to join the room, the room is created if it does not exist
+func JoinRoom(name string) *Frame {
+	return JoinRoomWith(name, RoomOptions{})
+}
+
+// JoinRoomWith builds request to join the room with password or to create the room with the options
+func JoinRoomWith(name string, opts RoomOptions) *Frame {
+	p := name
+	if opts.Private || opts.Password != "" {
+		mode := ""
+		if opts.Private {
+			mode = roomPrivate
+		}
+		p += roomSeparator + mode + roomSeparator + opts.Password
+	}
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeJoinRoom,
+		Payload: []byte(p),
+	}
+}
+
+// ParseJoin returns room name and options of join request
+func ParseJoin(f *Frame) (name string, opts RoomOptions) {
+	parts := strings.SplitN(string(f.Payload), roomSeparator, 3)
+	if len(parts) > 1 {
+		opts.Private = parts[1] == roomPrivate
+	}
+	if len(parts) > 2 {
+		opts.Password = parts[2]
+	}
+	return parts[0], opts
+}
+
+// LeaveRoom builds request to leave the room
+func LeaveRoom(name string) *Frame {
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeLeaveRoom,
+		Payload: []byte(name),
+	}
+}
+
+// Invite builds request to invite client to the room, server sends it to the invited client as well
+func Invite(room, id string) *Frame {
+	return &Frame{
+		Version:   Version,
+		Type:      HeaderTypeInvite,
+		Recipient: id,
+		Payload:   []byte(room),
+	}
+}
+
+// Joined builds HeaderTypeNewClient event telling room members about the client joined the room
+func Joined(id, nick, room string) *Frame {
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeNewClient,
+		Sender:  id,
+		Payload: roomNickPayload(room, nick),
+	}
+}
+
+// Member builds HeaderTypeClientList frame telling recipient about the room member
+func Member(id, nick, room, recipient string) *Frame {
+	return &Frame{
+		Version:   Version,
+		Type:      HeaderTypeClientList,
+		Sender:    id,
+		Recipient: recipient,
+		Payload:   roomNickPayload(room, nick),
+	}
+}
+
+func roomNickPayload(room, nick string) []byte {
+	if nick == "" {
+		return []byte(room)
+	}
+	return []byte(room + roomSeparator + nick)
+}
+
+// Left builds HeaderTypeLeaveRoom event telling room members about the client left the room
+func Left(id, room string) *Frame {
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeLeaveRoom,
+		Sender:  id,
+		Payload: []byte(room),
+	}
+}
+
+// Room returns room name carried by room request or event
+func Room(f *Frame) string {
+	name := string(f.Payload)
+	if i := strings.Index(name, roomSeparator); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// SetTopic builds request to change room topic, server sends it to room members as topic-changed event
+func SetTopic(room, topic string) *Frame {
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeSetTopic,
+		Payload: []byte(room + roomSeparator + topic),
+	}
+}
+
+// ParseTopic returns room name and topic of HeaderTypeSetTopic frame
+func ParseTopic(f *Frame) (room, topic string) {
+	p := string(f.Payload)
+	if i := strings.Index(p, roomSeparator); i >= 0 {
+		return p[:i], p[i+len(roomSeparator):]
+	}
+	return p, ""
+}
+
+// ListRooms builds request for room directory
+func ListRooms() *Frame {
+	return &Frame{
+		Version: Version,
+		Type:    HeaderTypeListRooms,
+	}
+}
+
+// RoomInfo room directory entry
+type RoomInfo struct {
+	Name       string
+	Topic      string
+	Members    int
+	Visibility uint8
+}
+
+// RoomList builds HeaderTypeRoomList frame with room directory.
+// Every entry is visibility byte, uint32 member count, name and topic with uint8 and uint16 lengths
+func RoomList(recipient string, rooms []RoomInfo) *Frame {
+	var p []byte
+	for _, r := range rooms {
+		var head [6]byte
+		head[0] = r.Visibility
+		binary.BigEndian.PutUint32(head[1:], uint32(r.Members))
+		head[5] = uint8(len(r.Name))
+		p = append(append(p, head[:]...), r.Name...)
+		var topicLen [2]byte
+		binary.BigEndian.PutUint16(topicLen[:], uint16(len(r.Topic)))
+		p = append(append(p, topicLen[:]...), r.Topic...)
+	}
+	return &Frame{
+		Version:   Version,
+		Type:      HeaderTypeRoomList,
+		Recipient: recipient,
+		Payload:   p,
+	}
+}
+
+// ParseRoomList parses HeaderTypeRoomList frame
+func ParseRoomList(f *Frame) ([]RoomInfo, error) {
+	if f.Type != HeaderTypeRoomList {
+		return nil, ErrWrongFormat
+	}
+	var rooms []RoomInfo
+	p := f.Payload
+	for len(p) > 0 {
+		if len(p) < 6 || len(p) < 6+int(p[5])+2 {
+			return nil, ErrWrongFormat
+		}
+		r := RoomInfo{Visibility: p[0], Members: int(binary.BigEndian.Uint32(p[1:]))}
+		nameEnd := 6 + int(p[5])
+		r.Name = string(p[6:nameEnd])
+		topicEnd := nameEnd + 2 + int(binary.BigEndian.Uint16(p[nameEnd:]))
+		if len(p) < topicEnd {
+			return nil, ErrWrongFormat
+		}
+		r.Topic = string(p[nameEnd+2 : topicEnd])
+		rooms = append(rooms, r)
+		p = p[topicEnd:]
+	}
+	return rooms, nil
+}
@@ -0,0 +1,86 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidRoomName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"general", true},
+		{"", false},
+		{"#general", false},
+		{"two words", false},
+		{"a,b", false},
+		{"ops\x00owner", false},
+		{"bell\a", false},
+		{string(make([]byte, MaxRoomName+1)), false},
+	}
+	for _, tt := range tests {
+		if got := ValidRoomName(tt.name); got != tt.want {
+			t.Errorf("ValidRoomName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRoomName(t *testing.T) {
+	name, ok := RoomName(RoomRecipient("general"))
+	if !ok || name != "general" {
+		t.Errorf("RoomName() = %q, %v, want %q, true", name, ok, "general")
+	}
+	if _, ok = RoomName("8a7c4b9e"); ok {
+		t.Error("RoomName() accepted client ID")
+	}
+}
+
+func TestParseJoin(t *testing.T) {
+	tests := []struct {
+		name string
+		opts RoomOptions
+	}{
+		{"public", RoomOptions{}},
+		{"private", RoomOptions{Private: true}},
+		{"protected", RoomOptions{Password: "pass\nword"}},
+		{"both", RoomOptions{Private: true, Password: "secret"}},
+	}
+	for _, tt := range tests {
+		f := JoinRoomWith(tt.name, tt.opts)
+		name, opts := ParseJoin(f)
+		if name != tt.name || !reflect.DeepEqual(opts, tt.opts) {
+			t.Errorf("ParseJoin() = %q, %v, want %q, %v", name, opts, tt.name, tt.opts)
+		}
+		if Room(f) != tt.name {
+			t.Errorf("Room() = %q, want %q", Room(f), tt.name)
+		}
+	}
+}
+
+func TestParseRoomList(t *testing.T) {
+	want := []RoomInfo{
+		{Name: "lobby", Members: 3, Visibility: VisibilityPublic},
+		{Name: "ops", Topic: "on call", Members: 1, Visibility: VisibilityPrivate},
+	}
+	got, err := ParseRoomList(RoomList("a", want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseRoomList() = %v, want %v", got, want)
+	}
+
+	f := RoomList("a", want)
+	f.Payload = f.Payload[:len(f.Payload)-1]
+	if _, err = ParseRoomList(f); err == nil {
+		t.Error("ParseRoomList() accepted truncated payload")
+	}
+}
+
+func TestParseTopic(t *testing.T) {
+	room, topic := ParseTopic(SetTopic("dev", "release\nfriday"))
+	if room != "dev" || topic != "release\nfriday" {
+		t.Errorf("ParseTopic() = %q, %q", room, topic)
+	}
+}
@@ -0,0 +1,109 @@
+package message
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// maxPooledBuffer buffers grown over this size are not returned to the pool
+const maxPooledBuffer = 64 << 10
+
+var buffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+func getBuffer() *[]byte {
+	return buffers.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
+		return
+	}
+	*b = (*b)[:0]
+	buffers.Put(b)
+}
+
+// Writer writes frames to stream encoding them into pooled buffers, it is safe for concurrent use
+type Writer struct {
+	mu        sync.Mutex
+	w         io.Writer
+	sync      bool
+	checksum  bool
+	compress  bool
+	threshold int
+}
+
+// NewWriter creates new Writer
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// SetSync turns sync mode on or off, in sync mode every frame is preceded by Magic
+func (w *Writer) SetSync(sync bool) {
+	w.mu.Lock()
+	w.sync = sync
+	w.mu.Unlock()
+}
+
+// SetChecksum turns CRC32C trailer on or off
+func (w *Writer) SetChecksum(checksum bool) {
+	w.mu.Lock()
+	w.checksum = checksum
+	w.mu.Unlock()
+}
+
+// SetCompression turns compression of payloads not shorter than threshold on or off
+func (w *Writer) SetCompression(compress bool, threshold int) {
+	w.mu.Lock()
+	w.compress = compress
+	w.threshold = threshold
+	w.mu.Unlock()
+}
+
+// Write encodes frame and writes it to stream with a single Write call
+func (w *Writer) Write(f *Frame) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	data := (*buf)[:0]
+	if w.sync {
+		data = append(data, Magic[:]...)
+	}
+
+	frame := *f
+	if w.checksum {
+		frame.Flags |= FlagChecksum
+	}
+	var compressed *bytes.Buffer
+	if w.compress && len(frame.Payload) >= w.threshold && frame.Flags&FlagCompressed == 0 {
+		cbuf := getBuffer()
+		compressed = bytes.NewBuffer((*cbuf)[:0])
+		defer func() {
+			*cbuf = compressed.Bytes()
+			putBuffer(cbuf)
+		}()
+		ok, err := compressTo(compressed, frame.Payload)
+		if err != nil {
+			return err
+		}
+		if ok {
+			frame.Flags |= FlagCompressed
+			frame.Payload = compressed.Bytes()
+		}
+	}
+
+	data, err := AppendEncode(data, &frame)
+	if err != nil {
+		return err
+	}
+	*buf = data
+	_, err = w.w.Write(data)
+	return err
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	msg "tcp-serv-test/internal/message"
+)
+
+// ErrBadCredentials user is unknown or password is wrong
+var ErrBadCredentials = errors.New("invalid user name or password")
+
+// Authenticator checks client credentials in handshake
+type Authenticator interface {
+	// Authenticate returns ErrBadCredentials if user is unknown or password is wrong,
+	// other errors mean credentials can't be checked
+	Authenticate(user, password string) error
+}
+
+// MemoryAuthenticator keeps users in memory, it is meant for tests
+type MemoryAuthenticator struct {
+	mu sync.RWMutex
+	// users SHA-256 of passwords by user name
+	users map[string][]byte
+}
+
+// NewMemoryAuthenticator creates MemoryAuthenticator without users
+func NewMemoryAuthenticator() *MemoryAuthenticator {
+	return &MemoryAuthenticator{users: map[string][]byte{}}
+}
+
+// Add adds user or changes its password
+func (a *MemoryAuthenticator) Add(user, password string) {
+	sum := sha256.Sum256([]byte(password))
+	a.mu.Lock()
+	a.users[user] = sum[:]
+	a.mu.Unlock()
+}
+
+// Remove removes user
+func (a *MemoryAuthenticator) Remove(user string) {
+	a.mu.Lock()
+	delete(a.users, user)
+	a.mu.Unlock()
+}
+
+// Authenticate implements Authenticator
+func (a *MemoryAuthenticator) Authenticate(user, password string) error {
+	a.mu.RLock()
+	want, ok := a.users[user]
+	a.mu.RUnlock()
+	sum := sha256.Sum256([]byte(password))
+	if !ok || subtle.ConstantTimeCompare(sum[:], want) != 1 {
+		return ErrBadCredentials
+	}
+	return nil
+}
+
+// authenticate reads client credentials sent after hello and checks them, it returns the user name.
+// Clients failed authentication or sent no credentials within HandshakeTimeout get HeaderTypeError frame
+func (s *Server) authenticate(conn net.Conn, reader *msg.Reader) (string, error) {
+	f, err := reader.Read()
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// client waiting for welcome without sending credentials
+			s.reject(conn, msg.ErrCodeAuth, "authentication required")
+		}
+		return "", err
+	}
+	if f.Type != msg.HeaderTypeAuth {
+		s.reject(conn, msg.ErrCodeAuth, "authentication required")
+		return "", fmt.Errorf("unexpected frame type %d, credentials expected", f.Type)
+	}
+	user, password, err := msg.ParseAuth(f)
+	if err != nil {
+		s.reject(conn, msg.ErrCodeAuth, "malformed credentials")
+		return "", err
+	}
+	if err = s.Authenticator.Authenticate(user, password); err != nil {
+		text := ErrBadCredentials.Error()
+		if !errors.Is(err, ErrBadCredentials) {
+			text = "authentication failed"
+		}
+		s.reject(conn, msg.ErrCodeAuth, text)
+		return "", fmt.Errorf("authentication of %q failed: %w", user, err)
+	}
+	return user, nil
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"log"
+	"net"
+	"time"
+
+	msg "tcp-serv-test/internal/message"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// DefaultMessageQueueSize default size of the queue of messages waiting for dispatch
+const DefaultMessageQueueSize = 1000
+
+// DefaultStopTimeout default time given to Stop called by Run
+const DefaultStopTimeout = time.Minute
+
+// Config server settings, New replaces zero fields by DefaultConfig values
+// unless zero is documented to disable the setting
+type Config struct {
+	// Listener accepts client connections, the server listens on its address when it is nil
+	Listener net.Listener
+	// Logger receives server logs
+	Logger *log.Logger
+	// NewID generates IDs of connections, IDs must be unique and not longer than 255 bytes
+	NewID func() string
+
+	// MaxFrameSize max frame body size accepted from clients
+	MaxFrameSize int
+	// HandshakeTimeout time for client to send hello
+	HandshakeTimeout time.Duration
+	// CompressThreshold min payload size compressed for clients negotiated compression
+	CompressThreshold int
+	// DropCorrupted closes connections sending frames with wrong checksum
+	DropCorrupted bool
+	// OnResync is called with count of bytes skipped to find the next valid frame from connection in sync mode
+	OnResync func(connID string, skipped int)
+	// MessageQueueSize size of the queue of messages waiting for dispatch, it is applied by New only
+	MessageQueueSize int
+	// QueueSize outbound queue size of every connection
+	QueueSize int
+	// OverflowPolicy action taken when outbound queue of a connection is full
+	OverflowPolicy OverflowPolicy
+	// WriteTimeout deadline of every write to connection, 0 disables deadlines
+	WriteTimeout time.Duration
+	// MaxWriteTimeouts count of write timeouts in a row after which client is evicted as slow consumer
+	MaxWriteTimeouts int
+	// WriteLinger time to wait for more frames before writing queued frames to connection
+	WriteLinger time.Duration
+	// WriteBatch max count of frames written to connection at once, 1 disables batching
+	WriteBatch int
+	// HeartbeatInterval time between pings sent to every client, 0 disables heartbeats
+	HeartbeatInterval time.Duration
+	// HeartbeatMisses count of intervals without reply after which client is evicted
+	HeartbeatMisses int
+	// IdleTimeout closes connections sending no messages for this time, 0 disables the limit
+	IdleTimeout time.Duration
+	// MaxSessionTime closes connections open for this time, 0 disables the limit
+	MaxSessionTime time.Duration
+	// StopTimeout time given to Stop when Run context is done
+	StopTimeout time.Duration
+	// ShutdownMessage operator message sent to clients by Stop
+	ShutdownMessage string
+	// ReconnectHint time after which clients may reconnect, sent to clients by Stop
+	ReconnectHint time.Duration
+	// ResumeWindow time a disconnected client may resume its session with the token got in handshake,
+	// 0 disables resumption
+	ResumeWindow time.Duration
+	// DefaultRoom room joined by every new client and addressed by messages without recipient
+	DefaultRoom string
+	// NoDefaultRoom disables DefaultRoom, clients join rooms themselves and messages need recipient
+	NoDefaultRoom bool
+	// ReservedNicks nicknames nobody may take, they are compared case-insensitively
+	ReservedNicks []string
+	// Authenticator checks credentials sent by clients in handshake, nil lets everyone in.
+	// Authenticated clients get their user name as nickname and may not change it
+	Authenticator Authenticator
+}
+
+// DefaultConfig returns config with default settings
+func DefaultConfig() Config {
+	return Config{
+		Logger:            log.Default(),
+		NewID:             newUUID,
+		MaxFrameSize:      msg.DefaultMaxSize,
+		HandshakeTimeout:  DefaultHandshakeTimeout,
+		CompressThreshold: msg.DefaultCompressThreshold,
+		MessageQueueSize:  DefaultMessageQueueSize,
+		QueueSize:         DefaultQueueSize,
+		OverflowPolicy:    DropOldest,
+		WriteTimeout:      DefaultWriteTimeout,
+		MaxWriteTimeouts:  DefaultMaxWriteTimeouts,
+		WriteLinger:       DefaultWriteLinger,
+		WriteBatch:        DefaultWriteBatch,
+		HeartbeatInterval: DefaultHeartbeatInterval,
+		HeartbeatMisses:   DefaultHeartbeatMisses,
+		StopTimeout:       DefaultStopTimeout,
+		DefaultRoom:       DefaultRoom,
+		ReservedNicks:     DefaultReservedNicks,
+	}
+}
+
+// fillDefaults replaces zero or negative fields without a meaning of zero by DefaultConfig values
+func (c *Config) fillDefaults() {
+	d := DefaultConfig()
+	if c.Logger == nil {
+		c.Logger = d.Logger
+	}
+	if c.NewID == nil {
+		c.NewID = d.NewID
+	}
+	if c.MaxFrameSize <= 0 {
+		c.MaxFrameSize = d.MaxFrameSize
+	}
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = d.HandshakeTimeout
+	}
+	if c.CompressThreshold <= 0 {
+		c.CompressThreshold = d.CompressThreshold
+	}
+	if c.MessageQueueSize <= 0 {
+		c.MessageQueueSize = d.MessageQueueSize
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = d.QueueSize
+	}
+	if c.MaxWriteTimeouts <= 0 {
+		c.MaxWriteTimeouts = d.MaxWriteTimeouts
+	}
+	if c.WriteBatch <= 0 {
+		c.WriteBatch = d.WriteBatch
+	}
+	if c.HeartbeatMisses <= 0 {
+		c.HeartbeatMisses = d.HeartbeatMisses
+	}
+	if c.StopTimeout <= 0 {
+		c.StopTimeout = d.StopTimeout
+	}
+	if c.NoDefaultRoom {
+		c.DefaultRoom = ""
+	} else if c.DefaultRoom == "" {
+		c.DefaultRoom = d.DefaultRoom
+	}
+}
+
+func newUUID() string {
+	return uuid.NewV4().String()
+}
+
+// Option changes server settings
+type Option func(*Config)
+
+// WithConfig replaces all settings with cfg, New fills its zero fields by defaults
+func WithConfig(cfg Config) Option {
+	return func(c *Config) {
+		*c = cfg
+	}
+}
+
+// WithListener makes server accept connections from l instead of listening on its address
+func WithListener(l net.Listener) Option {
+	return func(c *Config) {
+		c.Listener = l
+	}
+}
+
+// WithLogger sets server logger
+func WithLogger(l *log.Logger) Option {
+	return func(c *Config) {
+		c.Logger = l
+	}
+}
+
+// WithIDGenerator sets generator of connection IDs
+func WithIDGenerator(newID func() string) Option {
+	return func(c *Config) {
+		c.NewID = newID
+	}
+}
+
+// WithMaxFrameSize sets max frame body size accepted from clients
+func WithMaxFrameSize(size int) Option {
+	return func(c *Config) {
+		c.MaxFrameSize = size
+	}
+}
+
+// WithQueueSizes sets size of the dispatch queue and of the outbound queue of every connection
+func WithQueueSizes(messages, connection int) Option {
+	return func(c *Config) {
+		c.MessageQueueSize = messages
+		c.QueueSize = connection
+	}
+}
+
+// WithHandshakeTimeout sets time for client to send hello
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.HandshakeTimeout = d
+	}
+}
+
+// WithWriteTimeout sets deadline of writes and count of timeouts in a row after which client is evicted
+func WithWriteTimeout(d time.Duration, maxTimeouts int) Option {
+	return func(c *Config) {
+		c.WriteTimeout = d
+		c.MaxWriteTimeouts = maxTimeouts
+	}
+}
+
+// WithHeartbeat sets ping interval and count of missed intervals after which client is evicted
+func WithHeartbeat(interval time.Duration, misses int) Option {
+	return func(c *Config) {
+		c.HeartbeatInterval = interval
+		c.HeartbeatMisses = misses
+	}
+}
+
+// WithSessionTimeouts sets idle timeout and max session time
+func WithSessionTimeouts(idle, session time.Duration) Option {
+	return func(c *Config) {
+		c.IdleTimeout = idle
+		c.MaxSessionTime = session
+	}
+}
+
+// WithShutdownNotice sets operator message and reconnect hint sent to clients by Stop
+func WithShutdownNotice(text string, reconnect time.Duration) Option {
+	return func(c *Config) {
+		c.ShutdownMessage = text
+		c.ReconnectHint = reconnect
+	}
+}
+
+// WithResumeWindow sets time a disconnected client may resume its session
+func WithResumeWindow(d time.Duration) Option {
+	return func(c *Config) {
+		c.ResumeWindow = d
+	}
+}
+
+// WithDefaultRoom sets room joined by every new client, empty name disables it
+func WithDefaultRoom(name string) Option {
+	return func(c *Config) {
+		c.DefaultRoom = name
+		c.NoDefaultRoom = name == ""
+	}
+}
+
+// WithReservedNicks sets nicknames nobody may take
+func WithReservedNicks(nicks ...string) Option {
+	return func(c *Config) {
+		c.ReservedNicks = nicks
+	}
+}
+
+// WithAuthenticator requires clients to authenticate in handshake
+func WithAuthenticator(a Authenticator) Option {
+	return func(c *Config) {
+		c.Authenticator = a
+	}
+}
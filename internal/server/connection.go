@@ -0,0 +1,283 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	msg "tcp-serv-test/internal/message"
+)
+
+// Outbound queue defaults
+const (
+	DefaultQueueSize   = 1024
+	DefaultWriteLinger = time.Millisecond
+	DefaultWriteBatch  = 64
+
+	DefaultWriteTimeout     = 10 * time.Second
+	DefaultMaxWriteTimeouts = 3
+)
+
+var errSlowConsumer = errors.New("slow consumer")
+
+// OverflowPolicy action taken when outbound queue of a connection is full
+type OverflowPolicy int
+
+// Overflow policies
+const (
+	// DropOldest drops the oldest queued frame to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// DropNewest drops the new frame
+	DropNewest
+	// Disconnect closes the slow connection
+	Disconnect
+)
+
+type connection struct {
+	// rtt the last heartbeat round-trip time in nanoseconds
+	rtt int64
+
+	id   string
+	conn net.Conn
+	caps map[string]bool
+	// user name of authenticated client
+	user string
+
+	// out outbound queue, drained by the connection writer goroutine
+	out       chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	// reason disconnect reason set when server evicts the connection
+	reason int32
+	// misses count of heartbeat intervals passed since the last frame from client
+	misses int32
+	// bye the last frame written by the connection writer after queued frames, then the writer stops
+	bye chan []byte
+	// stopped is closed when the connection writer stops
+	stopped chan struct{}
+
+	// started and active time of session start and of the last client message, used by the reader only
+	started time.Time
+	active  time.Time
+	// unread data read from client but not handled when server stopped, it is passed on handoff
+	unread []byte
+
+	// token resumes session of the connection after disconnect
+	token string
+	// resumed connection continues a parked session
+	resumed bool
+	// parked is set while session waits for the client to reconnect, the queue keeps getting frames
+	parked int32
+	// expiry ends parked session, expiry and parkReason are guarded by Server.sessionMu
+	expiry     *time.Timer
+	parkReason uint8
+}
+
+func newConnection(id string, conn net.Conn, queueSize int) *connection {
+	now := time.Now()
+	return &connection{
+		id:      id,
+		conn:    conn,
+		caps:    map[string]bool{},
+		out:     make(chan []byte, queueSize),
+		done:    make(chan struct{}),
+		bye:     make(chan []byte, 1),
+		stopped: make(chan struct{}),
+		started: now,
+		active:  now,
+	}
+}
+
+// encoding frame encoding negotiated by connection
+type encoding struct {
+	flags uint8
+	sync  bool
+}
+
+func (c *connection) encoding() encoding {
+	e := encoding{sync: c.caps[msg.CapSync]}
+	if c.caps[msg.CapCompression] {
+		e.flags |= msg.FlagCompressed
+	}
+	if c.caps[msg.CapChecksum] {
+		e.flags |= msg.FlagChecksum
+	}
+	return e
+}
+
+// close stops connection writer and closes the socket
+func (c *connection) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
+
+// evict closes connection for the reason, the first reason wins
+func (c *connection) evict(reason uint8) {
+	atomic.CompareAndSwapInt32(&c.reason, 0, int32(reason))
+	c.close()
+}
+
+func (c *connection) evictReason() uint8 {
+	return uint8(atomic.LoadInt32(&c.reason))
+}
+
+func (c *connection) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueue puts frame into the outbound queue applying OverflowPolicy when the queue is full.
+// It is called by sendMessages goroutine only
+func (s *Server) enqueue(c *connection, data []byte) {
+	if c.closed() && !c.isParked() {
+		return
+	}
+	for {
+		select {
+		case c.out <- data:
+			return
+		default:
+		}
+
+		switch s.OverflowPolicy {
+		case DropNewest:
+			s.Logger.Printf("queue of %q is full, frame dropped", c.id)
+			return
+		case Disconnect:
+			s.Logger.Printf("queue of %q is full, disconnecting slow client", c.id)
+			c.evict(msg.ReasonSlowConsumer)
+			return
+		default:
+			select {
+			case <-c.out:
+				s.Logger.Printf("queue of %q is full, oldest frame dropped", c.id)
+			default:
+			}
+		}
+	}
+}
+
+// writeLoop writes queued frames to connection, frames queued within WriteLinger are written with one writev
+func (s *Server) writeLoop(c *connection) {
+	defer close(c.stopped)
+	pending := make(net.Buffers, 0, s.WriteBatch)
+	for {
+		select {
+		case data := <-c.out:
+			pending = s.collect(c, append(pending[:0], data))
+			err := s.write(c, pending)
+			if err == errSlowConsumer {
+				s.Logger.Printf("writes to %q keep timing out, disconnecting slow client", c.id)
+				c.evict(msg.ReasonSlowConsumer)
+				return
+			}
+			if err != nil {
+				s.Logger.Printf("can't send message to %q", c.id)
+				c.evict(msg.ReasonError)
+				return
+			}
+		case data := <-c.bye:
+			if err := s.flush(c, pending[:0], data); err != nil {
+				s.Logger.Printf("can't send goodbye to %q", c.id)
+			}
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// flush writes frames left in the outbound queue followed by the last frame, if any
+func (s *Server) flush(c *connection, pending net.Buffers, last []byte) error {
+	for {
+		select {
+		case data := <-c.out:
+			pending = append(pending, data)
+			if len(pending) < s.WriteBatch {
+				continue
+			}
+		default:
+			if last != nil {
+				pending = append(pending, last)
+			}
+			if len(pending) == 0 {
+				return nil
+			}
+			return s.write(c, pending)
+		}
+		if err := s.write(c, pending); err != nil {
+			return err
+		}
+		pending = pending[:0]
+	}
+}
+
+// write writes frames to connection, a timed out write is retried with the rest of frames
+// until MaxWriteTimeouts timeouts in a row
+func (s *Server) write(c *connection, pending net.Buffers) error {
+	bufs := pending
+	for timeouts := 0; ; {
+		if s.WriteTimeout > 0 {
+			_ = c.conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+		}
+		atomic.AddUint64(&s.writes, 1)
+		_, err := bufs.WriteTo(c.conn)
+		var netErr net.Error
+		if err == nil || !errors.As(err, &netErr) || !netErr.Timeout() {
+			return err
+		}
+		timeouts++
+		s.Logger.Printf("write to %q timed out", c.id)
+		if timeouts >= s.MaxWriteTimeouts {
+			return errSlowConsumer
+		}
+	}
+}
+
+// collect adds frames queued within WriteLinger to pending, up to WriteBatch frames
+func (s *Server) collect(c *connection, pending net.Buffers) net.Buffers {
+	if len(pending) >= s.WriteBatch {
+		return pending
+	}
+	t := time.NewTimer(s.WriteLinger)
+	defer t.Stop()
+	for len(pending) < s.WriteBatch {
+		select {
+		case data := <-c.out:
+			pending = append(pending, data)
+		case <-t.C:
+			return pending
+		}
+	}
+	return pending
+}
+
+// QueueDepth returns count of frames waiting in the outbound queue of client
+func (s *Server) QueueDepth(connID string) (int, bool) {
+	value, ok := s.connMap.Load(connID)
+	if !ok {
+		return 0, false
+	}
+	c, ok := value.(*connection)
+	if !ok {
+		return 0, false
+	}
+	return len(c.out), true
+}
+
+// capabilities returns capabilities negotiated by connection
+func (c *connection) capabilities() []string {
+	caps := make([]string, 0, len(c.caps))
+	for capability := range c.caps {
+		caps = append(caps, capability)
+	}
+	return caps
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	msg "tcp-serv-test/internal/message"
+)
+
+// ErrNoFile listener or connection does not provide file descriptor
+var ErrNoFile = errors.New("file descriptor is not available")
+
+// HandoffConn live client connection passed to another server
+type HandoffConn struct {
+	ID    string    `json:"id"`
+	Token string    `json:"token"`
+	Caps  []string  `json:"caps"`
+	Rooms []RoomRef `json:"rooms"`
+	Nick  string    `json:"nick"`
+	User  string    `json:"user"`
+	// Unread data read from client but not handled yet
+	Unread []byte `json:"unread"`
+	// File duplicate of the connection socket
+	File *os.File `json:"-"`
+}
+
+// RoomRef names room of client passed to another server, Owner is set for private rooms,
+// names of private rooms are scoped by owner
+type RoomRef struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner,omitempty"`
+}
+
+// HandoffRoom room settings passed to another server, room members are passed in HandoffConn
+type HandoffRoom struct {
+	Name    string `json:"name"`
+	Owner   string `json:"owner"`
+	Private bool   `json:"private"`
+	// Password SHA-256 of room password
+	Password []byte   `json:"password"`
+	Invited  []string `json:"invited"`
+	Topic    string   `json:"topic"`
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// ListenerFile returns duplicate of the listener socket, so another process can accept connections
+// while server is still serving
+func (s *Server) ListenerFile() (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.listener.(filer)
+	if !ok {
+		return nil, ErrNoFile
+	}
+	return l.File()
+}
+
+// Handoff stops server like Stop, but instead of closing client connections it flushes their
+// outbound queues, stops reading and returns them, so another server can Adopt them.
+// Parked sessions end and other clients are told about them before the queues are flushed.
+// On ctx done the rest of connections are closed and ctx error is returned
+func (s *Server) Handoff(ctx context.Context) ([]HandoffConn, error) {
+	atomic.StoreInt32(&s.handoff, 1)
+	// parked sessions have no sockets to pass, they end while dispatcher still runs
+	s.endParked()
+	s.mu.Lock()
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	s.mu.Unlock()
+	s.dispatch.Wait()
+
+	// all connections are closed here, handlers leave them open on handoff
+	var all, conns []*connection
+	s.connMap.Range(func(connID, value interface{}) bool {
+		c, ok := value.(*connection)
+		if !ok {
+			return true
+		}
+		all = append(all, c)
+		// nil flushes the queue without the last frame
+		select {
+		case c.bye <- nil:
+			conns = append(conns, c)
+		default:
+		}
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.group.Wait()
+		close(done)
+	}()
+
+	handoff := make([]HandoffConn, 0, len(conns))
+	err := func() error {
+		for _, c := range conns {
+			select {
+			case <-c.stopped:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if c.closed() {
+				// evicted while flushing
+				continue
+			}
+			f, ok := c.conn.(filer)
+			if !ok {
+				s.Logger.Printf("can't hand off %q: %s", c.id, ErrNoFile)
+				continue
+			}
+			file, err := f.File()
+			if err != nil {
+				s.Logger.Printf("can't hand off %q: %s", c.id, err)
+				continue
+			}
+			handoff = append(handoff, HandoffConn{
+				ID:    c.id,
+				Token: c.token,
+				Caps:  c.capabilities(),
+				Rooms: s.memberRooms(c.id),
+				Nick:  s.nick(c.id),
+				User:  c.user,
+				File:  file,
+			})
+		}
+
+		// reader returns at once and keeps data read before the deadline
+		for _, c := range conns {
+			_ = c.conn.SetReadDeadline(time.Now())
+		}
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}()
+
+	for _, c := range all {
+		c.close()
+	}
+	if err != nil {
+		for _, hc := range handoff {
+			_ = hc.File.Close()
+		}
+		return nil, err
+	}
+
+	unread := map[string][]byte{}
+	for _, c := range conns {
+		unread[c.id] = c.unread
+	}
+	for i := range handoff {
+		handoff[i].Unread = unread[handoff[i].ID]
+	}
+	return handoff, nil
+}
+
+// HandoffRooms returns settings of rooms, it is called after Handoff
+func (s *Server) HandoffRooms() []HandoffRoom {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	rooms := make([]HandoffRoom, 0, len(s.rooms)+len(s.privateRooms))
+	for _, r := range s.allRoomsLocked() {
+		hr := HandoffRoom{
+			Name:     r.name,
+			Owner:    r.owner,
+			Private:  r.private,
+			Password: r.password,
+			Topic:    r.topic,
+		}
+		for id := range r.invited {
+			hr.Invited = append(hr.Invited, id)
+		}
+		rooms = append(rooms, hr)
+	}
+	return rooms
+}
+
+// AdoptRooms restores room settings passed by HandoffRooms of another server, it must be called before Adopt
+func (s *Server) AdoptRooms(rooms []HandoffRoom) {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	for _, hr := range rooms {
+		r := newRoom(hr.Name, hr.Owner, msg.RoomOptions{Private: hr.Private})
+		r.password = hr.Password
+		r.topic = hr.Topic
+		for _, id := range hr.Invited {
+			r.invited[id] = true
+		}
+		s.storeRoomLocked(r)
+	}
+}
+
+func (s *Server) handingOff() bool {
+	return atomic.LoadInt32(&s.handoff) == 1
+}
+
+// Adopt serves connections passed by Handoff of another server keeping their IDs, capabilities,
+// rooms and nicknames, other clients are not notified about them
+func (s *Server) Adopt(conns []HandoffConn) error {
+	for i, hc := range conns {
+		conn, err := net.FileConn(hc.File)
+		_ = hc.File.Close()
+		if err == nil && !s.track() {
+			_ = conn.Close()
+			err = net.ErrClosed
+		}
+		if err != nil {
+			for _, rest := range conns[i+1:] {
+				_ = rest.File.Close()
+			}
+			s.pruneRooms()
+			return err
+		}
+
+		c := newConnection(hc.ID, conn, s.QueueSize)
+		c.token = hc.Token
+		c.user = hc.User
+		for _, capability := range hc.Caps {
+			c.caps[capability] = true
+		}
+		for _, ref := range hc.Rooms {
+			s.addMember(ref, c.id)
+		}
+		if hc.Nick != "" {
+			s.nickMu.Lock()
+			s.setNickLocked(c.id, hc.Nick)
+			s.nickMu.Unlock()
+		}
+		var r io.Reader = conn
+		if len(hc.Unread) > 0 {
+			r = io.MultiReader(bytes.NewReader(hc.Unread), conn)
+		}
+		// stored at once, so frames to adopted clients are queued until their handlers start
+		s.connMap.Store(c.id, c)
+		go func() {
+			defer s.group.Done()
+			reader := msg.NewReader(r, s.MaxFrameSize)
+			defer reader.Release()
+			s.serve(c, reader, false)
+		}()
+	}
+	s.pruneRooms()
+	return nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	msg "tcp-serv-test/internal/message"
+)
+
+// DefaultHandshakeTimeout default time for client to send hello
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// capabilities supported by server
+var capabilities = []string{msg.CapCompression, msg.CapChecksum, msg.CapSync}
+
+// handshake reads client hello and, if Authenticator is set, client credentials, assigns connection ID,
+// or resumes the session of hello token, and replies with the agreed capabilities.
+// Clients with incompatible protocol version or failed authentication get HeaderTypeError frame
+func (s *Server) handshake(conn net.Conn, reader *msg.Reader) (*connection, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(s.HandshakeTimeout))
+	hello, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	if hello.Type != msg.HeaderTypeHello {
+		s.reject(conn, msg.ErrCodeHandshake, "hello expected")
+		return nil, fmt.Errorf("unexpected frame type %d", hello.Type)
+	}
+	if hello.Version != msg.Version {
+		s.reject(conn, msg.ErrCodeVersion, fmt.Sprintf("unsupported protocol version %d, server supports %d",
+			hello.Version, msg.Version))
+		return nil, fmt.Errorf("unsupported protocol version %d", hello.Version)
+	}
+	var user string
+	if s.Authenticator != nil {
+		if user, err = s.authenticate(conn, reader); err != nil {
+			return nil, err
+		}
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	requested, token := msg.ParseHandshake(hello)
+	agreed := msg.Negotiate(requested, capabilities)
+	c := s.resume(conn, token, agreed, user)
+	if c == nil {
+		id := s.NewID()
+		if id == "" || len(id) > msg.MaxIDLen {
+			s.reject(conn, msg.ErrCodeHandshake, "server error")
+			return nil, fmt.Errorf("generated connection ID %q is not valid", id)
+		}
+		c = newConnection(id, conn, s.QueueSize)
+		c.user = user
+		for _, capability := range agreed {
+			c.caps[capability] = true
+		}
+	}
+	if s.ResumeWindow > 0 {
+		c.token = newToken()
+	}
+	welcome, err := msg.Encode(msg.Welcome(c.id, c.token, agreed))
+	if err == nil {
+		_, err = conn.Write(welcome)
+	}
+	if err != nil {
+		if c.resumed {
+			s.endSession(c.id, msg.ReasonError)
+		}
+		return nil, err
+	}
+	if user != "" && !c.resumed {
+		// user name is nickname, so nobody impersonates the user
+		if code := s.claimNick(c.id, user); code != 0 {
+			s.Logger.Printf("user %q - %q has no nickname: %s\n", user, c.id, nickErrorText(code, user))
+		}
+	}
+	return c, nil
+}
+
+func (s *Server) reject(conn net.Conn, code uint16, text string) {
+	data, err := msg.Encode(msg.ErrorFrame(code, text))
+	if err != nil {
+		return
+	}
+	_, _ = conn.Write(data)
+}
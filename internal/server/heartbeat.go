@@ -0,0 +1,68 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	msg "tcp-serv-test/internal/message"
+)
+
+// Heartbeat defaults
+const (
+	DefaultHeartbeatInterval = 15 * time.Second
+	DefaultHeartbeatMisses   = 3
+)
+
+// heartbeat pings connection every HeartbeatInterval and evicts it
+// when nothing is received from it for HeartbeatMisses intervals
+func (s *Server) heartbeat(c *connection) {
+	if s.HeartbeatInterval <= 0 {
+		return
+	}
+	t := time.NewTicker(s.HeartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if int(atomic.AddInt32(&c.misses, 1)) > s.HeartbeatMisses {
+				s.Logger.Printf("no heartbeat from %q, disconnecting", c.id)
+				c.evict(msg.ReasonHeartbeat)
+				return
+			}
+			select {
+			case s.messages <- &message{recipient: c.id, frame: msg.Ping(time.Now())}:
+			case <-c.done:
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// alive resets missed heartbeats, any frame from client proves it is alive
+func (c *connection) alive() {
+	atomic.StoreInt32(&c.misses, 0)
+}
+
+// pong records round-trip time measured by the pong
+func (c *connection) pong(f *msg.Frame) {
+	sent, ok := msg.PingTime(f)
+	if !ok {
+		return
+	}
+	atomic.StoreInt64(&c.rtt, int64(time.Since(sent)))
+}
+
+// RTT returns the last round-trip time measured by heartbeat of client
+func (s *Server) RTT(connID string) (time.Duration, bool) {
+	value, ok := s.connMap.Load(connID)
+	if !ok {
+		return 0, false
+	}
+	c, ok := value.(*connection)
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(atomic.LoadInt64(&c.rtt)), true
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// scryptPrefix prefix of scrypt hashes in password file
+const scryptPrefix = "$scrypt$"
+
+var errUnsupportedHash = errors.New("unsupported password hash")
+
+// FileAuthenticator checks credentials against htpasswd-style file of "user:hash" lines, empty lines
+// and lines starting with '#' are skipped. Hashes are bcrypt, as made by "htpasswd -B", or scrypt
+// in "$scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<key>" form with unpadded base64 salt and key
+type FileAuthenticator struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]string
+	// dummy hash of a user from the file, unknown users are checked against it,
+	// so they are not told from known ones by response time
+	dummy string
+}
+
+// NewFileAuthenticator loads password file
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	a := &FileAuthenticator{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads password file again, the loaded users are kept if the file is invalid
+func (a *FileAuthenticator) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	var dummy string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return fmt.Errorf("%s:%d: user:hash expected", a.path, n)
+		}
+		user, hash := line[:i], line[i+1:]
+		if err = checkHash(hash); err != nil {
+			return fmt.Errorf("%s:%d: %w", a.path, n, err)
+		}
+		users[user] = hash
+		if dummy == "" {
+			dummy = hash
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.users, a.dummy = users, dummy
+	a.mu.Unlock()
+	return nil
+}
+
+// Authenticate implements Authenticator
+func (a *FileAuthenticator) Authenticate(user, password string) error {
+	a.mu.RLock()
+	hash, ok := a.users[user]
+	dummy := a.dummy
+	a.mu.RUnlock()
+	if !ok {
+		if dummy != "" {
+			_ = verifyHash(dummy, password)
+		}
+		return ErrBadCredentials
+	}
+	return verifyHash(hash, password)
+}
+
+// checkHash returns error if hash has unknown format
+func checkHash(hash string) error {
+	if strings.HasPrefix(hash, scryptPrefix) {
+		_, _, _, err := parseScrypt(hash)
+		return err
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return errUnsupportedHash
+	}
+	return nil
+}
+
+func verifyHash(hash, password string) error {
+	if !strings.HasPrefix(hash, scryptPrefix) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrBadCredentials
+		}
+		return err
+	}
+
+	params, salt, key, err := parseScrypt(hash)
+	if err != nil {
+		return err
+	}
+	got, err := scrypt.Key([]byte(password), salt, 1<<params.logN, params.r, params.p, len(key))
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(got, key) != 1 {
+		return ErrBadCredentials
+	}
+	return nil
+}
+
+type scryptParams struct {
+	logN, r, p int
+}
+
+func parseScrypt(hash string) (params scryptParams, salt, key []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(hash, scryptPrefix), "$")
+	if len(parts) != 3 {
+		return params, nil, nil, errUnsupportedHash
+	}
+	if _, err = fmt.Sscanf(parts[0], "ln=%d,r=%d,p=%d", &params.logN, &params.r, &params.p); err != nil {
+		return params, nil, nil, errUnsupportedHash
+	}
+	if params.logN < 1 || params.logN > 30 || params.r < 1 || params.p < 1 {
+		return params, nil, nil, errUnsupportedHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[1]); err != nil {
+		return params, nil, nil, errUnsupportedHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil || len(key) == 0 {
+		return params, nil, nil, errUnsupportedHash
+	}
+	return params, salt, key, nil
+}
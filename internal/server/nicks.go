@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	msg "tcp-serv-test/internal/message"
+)
+
+// DefaultReservedNicks nicknames nobody may take
+var DefaultReservedNicks = []string{"admin", "administrator", "root", "server", "system", "everyone", "all"}
+
+// nick returns client nickname, empty if client has no nickname
+func (s *Server) nick(id string) string {
+	s.nickMu.Lock()
+	defer s.nickMu.Unlock()
+	return s.nickOf[id]
+}
+
+// claimNick gives nickname to client releasing the previous one, it returns error code if nickname is not available.
+// Nicknames are compared case-insensitively and may not be equal to connection IDs
+func (s *Server) claimNick(id, nick string) uint16 {
+	if !msg.ValidNick(nick) {
+		return msg.ErrCodeNickInvalid
+	}
+	key := strings.ToLower(nick)
+	for _, reserved := range s.ReservedNicks {
+		if strings.ToLower(reserved) == key {
+			return msg.ErrCodeNickReserved
+		}
+	}
+	if _, ok := s.connMap.Load(nick); ok && nick != id {
+		return msg.ErrCodeNickTaken
+	}
+
+	s.nickMu.Lock()
+	defer s.nickMu.Unlock()
+	if owner, ok := s.nicks[key]; ok && owner != id {
+		return msg.ErrCodeNickTaken
+	}
+	s.setNickLocked(id, nick)
+	return 0
+}
+
+// setNickLocked gives nickname to client, nickMu must be held
+func (s *Server) setNickLocked(id, nick string) {
+	if old, ok := s.nickOf[id]; ok {
+		delete(s.nicks, strings.ToLower(old))
+	}
+	s.nicks[strings.ToLower(nick)] = id
+	s.nickOf[id] = nick
+}
+
+// releaseNick frees nickname of disconnected client
+func (s *Server) releaseNick(id string) {
+	s.nickMu.Lock()
+	defer s.nickMu.Unlock()
+	if nick, ok := s.nickOf[id]; ok {
+		delete(s.nicks, strings.ToLower(nick))
+		delete(s.nickOf, id)
+	}
+}
+
+// resolve returns connection ID of client addressed by ID or nickname, empty if client is unknown
+func (s *Server) resolve(recipient string) string {
+	if _, ok := s.connMap.Load(recipient); ok {
+		return recipient
+	}
+	s.nickMu.Lock()
+	defer s.nickMu.Unlock()
+	return s.nicks[strings.ToLower(recipient)]
+}
+
+// setNick changes nickname of message author and tells clients sharing a room with the author
+func (s *Server) setNick(m *message) {
+	nick := string(m.frame.Payload)
+	if s.Authenticator != nil {
+		// authenticated clients are known by user name
+		s.replyError(m.author, msg.ErrCodeNickLocked, "nickname is the user name")
+		return
+	}
+	if code := s.claimNick(m.author, nick); code != 0 {
+		s.replyError(m.author, code, nickErrorText(code, nick))
+		return
+	}
+	changed := &message{author: m.author, frame: msg.SetNick(nick)}
+	changed.frame.Sender = m.author
+	s.deliverTo(m.author, changed)
+	for _, id := range s.peers(m.author) {
+		s.deliverTo(id, changed)
+	}
+}
+
+func nickErrorText(code uint16, nick string) string {
+	switch code {
+	case msg.ErrCodeNickReserved:
+		return fmt.Sprintf("nickname %q is reserved", nick)
+	case msg.ErrCodeNickTaken:
+		return fmt.Sprintf("nickname %q is taken", nick)
+	default:
+		return fmt.Sprintf("invalid nickname %q, it must start with a letter and have up to %d letters, digits, '_', '-' or '.'",
+			nick, msg.MaxNick)
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+	"time"
+
+	msg "tcp-serv-test/internal/message"
+)
+
+// tokenSize size of random session token
+const tokenSize = 16
+
+func newToken() string {
+	b := make([]byte, tokenSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (c *connection) isParked() bool {
+	return atomic.LoadInt32(&c.parked) == 1
+}
+
+// resumable reports whether session may be resumed after disconnect with the reason
+func resumable(reason uint8) bool {
+	switch reason {
+	case msg.ReasonLeft, msg.ReasonError, msg.ReasonHeartbeat:
+		return true
+	default:
+		return false
+	}
+}
+
+// track indexes session of served connection by its token, so the client may resume it
+func (s *Server) trackSession(c *connection) {
+	if c.token == "" {
+		return
+	}
+	s.sessionMu.Lock()
+	s.sessions[c.token] = c
+	s.sessionMu.Unlock()
+}
+
+// retire removes session of connection closed by client or server,
+// false means the session is taken over by resume and the connection must leave quietly
+func (s *Server) retire(c *connection) bool {
+	if c.token == "" {
+		return true
+	}
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+	if s.sessions[c.token] != c {
+		return false
+	}
+	delete(s.sessions, c.token)
+	return true
+}
+
+// park keeps session of disconnected client for ResumeWindow, other clients are notified
+// about the disconnect only if the client does not come back in time
+func (s *Server) park(c *connection, reason uint8) bool {
+	if s.ResumeWindow <= 0 || c.token == "" || !resumable(reason) || s.stopping() || s.handingOff() {
+		return false
+	}
+	atomic.StoreInt32(&c.parked, 1)
+	c.close()
+
+	s.sessionMu.Lock()
+	s.sessions[c.token] = c
+	c.parkReason = reason
+	c.expiry = time.AfterFunc(s.ResumeWindow, func() {
+		s.expire(c)
+	})
+	s.sessionMu.Unlock()
+	s.Logger.Printf("session of %q is kept for %s\n", c.id, s.ResumeWindow)
+	return true
+}
+
+// expire ends parked session which is not resumed
+func (s *Server) expire(c *connection) {
+	s.sessionMu.Lock()
+	if s.sessions[c.token] != c {
+		s.sessionMu.Unlock()
+		return
+	}
+	delete(s.sessions, c.token)
+	s.sessionMu.Unlock()
+	s.endSession(c.id, c.parkReason)
+}
+
+// endParked ends all parked sessions at once
+func (s *Server) endParked() {
+	var parked []*connection
+	s.sessionMu.Lock()
+	for token, c := range s.sessions {
+		if c.isParked() && c.expiry.Stop() {
+			delete(s.sessions, token)
+			parked = append(parked, c)
+		}
+	}
+	s.sessionMu.Unlock()
+	for _, c := range parked {
+		s.endSession(c.id, c.parkReason)
+	}
+}
+
+// endSession removes client and tells other clients about the disconnect
+func (s *Server) endSession(id string, reason uint8) {
+	s.connMap.Delete(id)
+	s.clientDisconnectNotify(id, reason)
+}
+
+// resume returns connection continuing session of the token or nil, session is resumed by the same user only.
+// A live connection of the session, whose drop the server has not noticed yet, is closed.
+// The new connection takes over the queue of the session, so frames queued while client was away are delivered
+func (s *Server) resume(conn net.Conn, token string, agreed []string, user string) *connection {
+	if token == "" || s.ResumeWindow <= 0 {
+		return nil
+	}
+	s.sessionMu.Lock()
+	old, ok := s.sessions[token]
+	if !ok || old.user != user || !sameCaps(old.caps, agreed) {
+		// queued frames are encoded for the capabilities of session
+		s.sessionMu.Unlock()
+		return nil
+	}
+	delete(s.sessions, token)
+	if old.isParked() {
+		old.expiry.Stop()
+	} else {
+		// old handler leaves without notifying about disconnect, its queue keeps getting frames
+		atomic.StoreInt32(&old.parked, 1)
+		old.close()
+		s.Logger.Printf("session of %q is taken over by new connection\n", old.id)
+	}
+	s.sessionMu.Unlock()
+	// the queue is read by one writer at a time
+	<-old.stopped
+
+	c := newConnection(old.id, conn, 0)
+	c.out = old.out
+	c.caps = old.caps
+	c.user = old.user
+	c.started = old.started
+	c.resumed = true
+	return c
+}
+
+func sameCaps(caps map[string]bool, agreed []string) bool {
+	if len(caps) != len(agreed) {
+		return false
+	}
+	for _, capability := range agreed {
+		if !caps[capability] {
+			return false
+		}
+	}
+	return true
+}
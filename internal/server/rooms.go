@@ -0,0 +1,495 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"sort"
+
+	msg "tcp-serv-test/internal/message"
+)
+
+// DefaultRoom default name of room joined by every new client
+const DefaultRoom = "lobby"
+
+// room chat room, it exists while it has members
+type room struct {
+	name    string
+	members map[string]bool
+	// owner client created the room, only the owner invites to the room
+	owner   string
+	private bool
+	// password SHA-256 of room password, nil if room has no password
+	password []byte
+	// invited clients join without password, invitation is used up by join
+	invited map[string]bool
+	topic   string
+}
+
+func newRoom(name, owner string, opts msg.RoomOptions) *room {
+	r := &room{
+		name:    name,
+		members: map[string]bool{},
+		owner:   owner,
+		private: opts.Private,
+		invited: map[string]bool{},
+	}
+	if opts.Password != "" {
+		sum := sha256.Sum256([]byte(opts.Password))
+		r.password = sum[:]
+	}
+	return r
+}
+
+// privateKey key of private room, names of private rooms are scoped by owner, so a stranger joining the name
+// gets a room of its own and can't tell whether a private room of the name exists
+type privateKey struct {
+	owner string
+	name  string
+}
+
+// roomLocked returns room of the name as client sees it: the room client is a member of,
+// private room client owns or is invited to, or public room. roomMu must be held
+func (s *Server) roomLocked(name, id string) (*room, bool) {
+	for r := range s.memberOf[id] {
+		if r.name == name {
+			return r, true
+		}
+	}
+	if r, ok := s.privateRooms[privateKey{owner: id, name: name}]; ok {
+		return r, true
+	}
+	for _, r := range s.privateRooms {
+		if r.name == name && r.invited[id] {
+			return r, true
+		}
+	}
+	r, ok := s.rooms[name]
+	return r, ok
+}
+
+// storeRoomLocked adds room to the map of its kind, roomMu must be held
+func (s *Server) storeRoomLocked(r *room) {
+	if r.private {
+		s.privateRooms[privateKey{owner: r.owner, name: r.name}] = r
+		return
+	}
+	s.rooms[r.name] = r
+}
+
+// deleteRoomLocked removes room from the map of its kind, roomMu must be held
+func (s *Server) deleteRoomLocked(r *room) {
+	if r.private {
+		delete(s.privateRooms, privateKey{owner: r.owner, name: r.name})
+		return
+	}
+	delete(s.rooms, r.name)
+}
+
+// admit returns error code telling why client may not join the room, 0 if it may.
+// Strangers do not find private rooms by name, so private check is a safeguard only
+func (r *room) admit(id, password string) uint16 {
+	if id == r.owner || r.invited[id] {
+		return 0
+	}
+	if r.private {
+		return msg.ErrCodeRoomUnavailable
+	}
+	if r.password != nil {
+		sum := sha256.Sum256([]byte(password))
+		if subtle.ConstantTimeCompare(sum[:], r.password) != 1 {
+			return msg.ErrCodeWrongPassword
+		}
+	}
+	return 0
+}
+
+// enter adds client to room creating the room with the options if needed, it returns members the room had before.
+// Request of private room joins or creates private room only. Clients not admitted to the room get error code
+func (s *Server) enter(name, id string, opts msg.RoomOptions) (members []string, added bool, code uint16) {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	r, ok := s.roomLocked(name, id)
+	if ok && opts.Private && !r.private && !r.members[id] {
+		// private request does not join public room of the name
+		ok = false
+	}
+	if !ok {
+		r = newRoom(name, id, opts)
+		s.storeRoomLocked(r)
+	}
+	if r.members[id] {
+		return nil, false, 0
+	}
+	if code = r.admit(id, opts.Password); code != 0 {
+		return nil, false, code
+	}
+	delete(r.invited, id)
+	return s.addMemberLocked(r, id), true, 0
+}
+
+// addMember adds client to the room creating the room if needed
+func (s *Server) addMember(ref RoomRef, id string) {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	var r *room
+	if ref.Owner != "" {
+		r = s.privateRooms[privateKey{owner: ref.Owner, name: ref.Name}]
+	} else {
+		r = s.rooms[ref.Name]
+	}
+	if r == nil {
+		r = newRoom(ref.Name, ref.Owner, msg.RoomOptions{Private: ref.Owner != ""})
+		if ref.Owner == "" {
+			r.owner = id
+		}
+		s.storeRoomLocked(r)
+	}
+	s.addMemberLocked(r, id)
+}
+
+// addMemberLocked adds client to room, it returns members the room had before, roomMu must be held
+func (s *Server) addMemberLocked(r *room, id string) (members []string) {
+	members = r.memberList()
+	r.members[id] = true
+	if s.memberOf[id] == nil {
+		s.memberOf[id] = map[*room]bool{}
+	}
+	s.memberOf[id][r] = true
+	return members
+}
+
+// removeMember removes client from room, it returns members left in the room
+func (s *Server) removeMember(name, id string) (members []string, removed bool) {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	r, ok := s.roomLocked(name, id)
+	if !ok || !r.members[id] {
+		return nil, false
+	}
+	s.dropMember(r, id)
+	return r.memberList(), true
+}
+
+// removeFromRooms removes client from all its rooms, it returns members of these rooms
+func (s *Server) removeFromRooms(id string) []string {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	members := s.peersLocked(id)
+	for r := range s.memberOf[id] {
+		s.dropMember(r, id)
+	}
+	return members
+}
+
+// peers returns clients sharing a room with the client
+func (s *Server) peers(id string) []string {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	return s.peersLocked(id)
+}
+
+// peersLocked returns clients sharing a room with the client, roomMu must be held
+func (s *Server) peersLocked(id string) []string {
+	seen := map[string]bool{id: true}
+	var peers []string
+	for r := range s.memberOf[id] {
+		for member := range r.members {
+			if !seen[member] {
+				seen[member] = true
+				peers = append(peers, member)
+			}
+		}
+	}
+	return peers
+}
+
+// dropMember removes client from room deleting the empty room, roomMu must be held
+func (s *Server) dropMember(r *room, id string) {
+	delete(r.members, id)
+	if len(r.members) == 0 {
+		s.deleteRoomLocked(r)
+	}
+	delete(s.memberOf[id], r)
+	if len(s.memberOf[id]) == 0 {
+		delete(s.memberOf, id)
+	}
+}
+
+// pruneRooms deletes rooms left without members by Adopt
+func (s *Server) pruneRooms() {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	for _, r := range s.allRoomsLocked() {
+		if len(r.members) == 0 {
+			s.deleteRoomLocked(r)
+		}
+	}
+}
+
+// roomMembers returns members of room, ok is false if client is not a member
+func (s *Server) roomMembers(name, id string) (members []string, ok bool) {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	r, exists := s.roomLocked(name, id)
+	if !exists || !r.members[id] {
+		return nil, false
+	}
+	return r.memberList(), true
+}
+
+// memberRooms returns client rooms sorted by name
+func (s *Server) memberRooms(id string) []RoomRef {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	refs := make([]RoomRef, 0, len(s.memberOf[id]))
+	for r := range s.memberOf[id] {
+		ref := RoomRef{Name: r.name}
+		if r.private {
+			ref.Owner = r.owner
+		}
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Name < refs[j].Name
+	})
+	return refs
+}
+
+// allRoomsLocked returns public and private rooms, roomMu must be held
+func (s *Server) allRoomsLocked() []*room {
+	rooms := make([]*room, 0, len(s.rooms)+len(s.privateRooms))
+	for _, r := range s.rooms {
+		rooms = append(rooms, r)
+	}
+	for _, r := range s.privateRooms {
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
+
+func (r *room) visibility() uint8 {
+	switch {
+	case r.private:
+		return msg.VisibilityPrivate
+	case r.password != nil:
+		return msg.VisibilityPassword
+	default:
+		return msg.VisibilityPublic
+	}
+}
+
+// directory returns rooms sorted by name, private and password rooms are listed to their members only
+func (s *Server) directory(id string) []msg.RoomInfo {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	rooms := make([]msg.RoomInfo, 0, len(s.rooms))
+	for _, r := range s.allRoomsLocked() {
+		if (r.private || r.password != nil) && !r.members[id] {
+			continue
+		}
+		rooms = append(rooms, msg.RoomInfo{
+			Name:       r.name,
+			Topic:      r.topic,
+			Members:    len(r.members),
+			Visibility: r.visibility(),
+		})
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+	return rooms
+}
+
+// changeTopic sets room topic, it returns room members, ok is false if client is not a member
+func (s *Server) changeTopic(name, id, topic string) (members []string, ok bool) {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	r, exists := s.roomLocked(name, id)
+	if !exists || !r.members[id] {
+		return nil, false
+	}
+	r.topic = topic
+	return r.memberList(), true
+}
+
+// roomTopic returns topic of room as client sees it
+func (s *Server) roomTopic(name, id string) string {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	if r, ok := s.roomLocked(name, id); ok {
+		return r.topic
+	}
+	return ""
+}
+
+func (r *room) memberList() []string {
+	members := make([]string, 0, len(r.members))
+	for id := range r.members {
+		members = append(members, id)
+	}
+	return members
+}
+
+// join adds message author to the room, tells members about the new client and sends the member list to it
+func (s *Server) join(m *message) {
+	name := msg.Room(m.frame)
+	if !msg.ValidRoomName(name) {
+		s.replyError(m.author, msg.ErrCodeRoomName, fmt.Sprintf("invalid room name %q", name))
+		return
+	}
+	_, opts := msg.ParseJoin(m.frame)
+	if name == s.DefaultRoom && (opts.Private || opts.Password != "") {
+		// every new client joins DefaultRoom, so nobody may lock it
+		s.replyError(m.author, msg.ErrCodeRoomUnavailable, msg.RoomRecipient(name)+" can't be private or have password")
+		return
+	}
+	members, added, code := s.enter(name, m.author, opts)
+	if code != 0 {
+		s.replyError(m.author, code, joinErrorText(code, name))
+		return
+	}
+	if !added {
+		return
+	}
+	joined := &message{author: m.author, frame: msg.Joined(m.author, s.nick(m.author), name)}
+	if m.confirm {
+		s.deliverTo(m.author, joined)
+	}
+	for _, id := range members {
+		s.deliverTo(id, joined)
+	}
+	for _, id := range members {
+		s.deliverTo(m.author, &message{recipient: m.author, frame: msg.Member(id, s.nick(id), name, m.author)})
+	}
+	if topic := s.roomTopic(name, m.author); topic != "" {
+		s.deliverTo(m.author, &message{recipient: m.author, frame: msg.SetTopic(name, topic)})
+	}
+}
+
+// leave removes message author from the room and tells the rest of members
+func (s *Server) leave(m *message) {
+	name := msg.Room(m.frame)
+	members, removed := s.removeMember(name, m.author)
+	if !removed {
+		s.replyError(m.author, msg.ErrCodeNotMember, "not a member of "+msg.RoomRecipient(name))
+		return
+	}
+	left := &message{author: m.author, frame: msg.Left(m.author, name)}
+	if m.confirm {
+		s.deliverTo(m.author, left)
+	}
+	for _, id := range members {
+		s.deliverTo(id, left)
+	}
+}
+
+// disconnect removes disconnected client from its rooms, tells their members and frees client nickname
+func (s *Server) disconnect(m *message) {
+	for _, id := range s.removeFromRooms(m.author) {
+		s.deliverTo(id, m)
+	}
+	s.releaseNick(m.author)
+}
+
+// broadcast delivers message to room members except author, author must be a member
+func (s *Server) broadcast(m *message, name string) {
+	if name == "" {
+		s.replyError(m.author, msg.ErrCodeNotMember, "message has no recipient")
+		return
+	}
+	members, ok := s.roomMembers(name, m.author)
+	if !ok {
+		s.replyError(m.author, msg.ErrCodeNotMember, "not a member of "+msg.RoomRecipient(name))
+		return
+	}
+	for _, id := range members {
+		if id != m.author {
+			s.deliverTo(id, m)
+		}
+	}
+}
+
+func joinErrorText(code uint16, name string) string {
+	switch code {
+	case msg.ErrCodeWrongPassword:
+		return "wrong password for " + msg.RoomRecipient(name)
+	default:
+		return msg.RoomRecipient(name) + " is not available"
+	}
+}
+
+// invite lets the invited client join the room, only room owner invites
+func (s *Server) invite(m *message) {
+	name := msg.Room(m.frame)
+	if _, ok := s.connMap.Load(m.recipient); !ok {
+		s.replyError(m.author, msg.ErrCodeNoClient, fmt.Sprintf("client %s is not connected", m.recipient))
+		return
+	}
+	if code := s.addInvite(name, m.author, m.recipient); code != 0 {
+		text := "only owner invites to " + msg.RoomRecipient(name)
+		if code == msg.ErrCodeRoomUnavailable {
+			text = msg.RoomRecipient(name) + " is not available"
+		}
+		s.replyError(m.author, code, text)
+		return
+	}
+	invited := &message{author: m.author, recipient: m.recipient, frame: msg.Invite(name, m.recipient)}
+	invited.frame.Sender = m.author
+	s.deliverTo(m.recipient, invited)
+	s.deliverTo(m.author, invited)
+}
+
+// addInvite records invitation, clients who are not members do not learn the room exists
+func (s *Server) addInvite(name, owner, id string) uint16 {
+	s.roomMu.Lock()
+	defer s.roomMu.Unlock()
+	r, ok := s.roomLocked(name, owner)
+	if !ok || (!r.members[owner] && r.owner != owner) {
+		return msg.ErrCodeRoomUnavailable
+	}
+	if r.owner != owner {
+		return msg.ErrCodeNotOwner
+	}
+	r.invited[id] = true
+	return 0
+}
+
+// listRooms sends room directory to message author
+func (s *Server) listRooms(m *message) {
+	f := msg.RoomList(m.author, s.directory(m.author))
+	for _, fragment := range msg.Split(f, msg.DefaultFragmentSize) {
+		s.deliverTo(m.author, &message{recipient: m.author, frame: fragment})
+	}
+}
+
+// setTopic changes room topic and tells room members including the author
+func (s *Server) setTopic(m *message) {
+	name, topic := msg.ParseTopic(m.frame)
+	if len(topic) > msg.MaxTopic {
+		s.replyError(m.author, msg.ErrCodeTopic, fmt.Sprintf("topic is longer than %d bytes", msg.MaxTopic))
+		return
+	}
+	members, ok := s.changeTopic(name, m.author, topic)
+	if !ok {
+		s.replyError(m.author, msg.ErrCodeNotMember, "not a member of "+msg.RoomRecipient(name))
+		return
+	}
+	changed := &message{author: m.author, frame: msg.SetTopic(name, topic)}
+	changed.frame.Sender = m.author
+	for _, id := range members {
+		s.deliverTo(id, changed)
+	}
+}
+
+// joinDefaultRoom puts new client into DefaultRoom
+func (s *Server) joinDefaultRoom(id string) {
+	if s.DefaultRoom == "" {
+		return
+	}
+	s.push(&message{author: id, frame: msg.JoinRoom(s.DefaultRoom)})
+}
+
+func (s *Server) replyError(id string, code uint16, text string) {
+	s.deliverTo(id, &message{recipient: id, frame: msg.ErrorFrame(code, text)})
+}
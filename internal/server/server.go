@@ -1,231 +1,572 @@
 package server
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
-	"strings"
 	"sync"
 	msg "tcp-serv-test/internal/message"
-
-	uuid "github.com/satori/go.uuid"
+	"time"
 )
 
 // Server tcp chat server
 type Server struct {
+	// writes count of connection writes, queued frames are written with one writev
+	writes uint64
+
+	// Config server settings, they must not be changed after Serve is called
+	Config
+
+	// mu guards listener, group.Add and dispatch.Add
+	mu       sync.Mutex
 	listener net.Listener
 	address  string
 	connMap  sync.Map
 	messages chan *message
 	group    *sync.WaitGroup
-	stops    bool
+	// dispatch waits for sendMessages goroutine
+	dispatch sync.WaitGroup
+	// quit is closed when server stops
+	quit     chan struct{}
+	quitOnce sync.Once
+	// handoff is set when server stops for Handoff
+	handoff int32
+
+	// sessions live and parked sessions by token
+	sessions  map[string]*connection
+	sessionMu sync.Mutex
+
+	// rooms public rooms by name, private rooms by owner and name and rooms of every client,
+	// membership is changed by sendMessages
+	rooms        map[string]*room
+	privateRooms map[privateKey]*room
+	memberOf     map[string]map[*room]bool
+	roomMu       sync.Mutex
+
+	// nicks connection IDs by lower case nickname and nicknames by connection ID
+	nicks  map[string]string
+	nickOf map[string]string
+	nickMu sync.Mutex
 }
 
-// New creates new Server
-func New(address string) *Server {
+// New creates new Server listening on address, options override DefaultConfig
+// and zero settings left by options are set to defaults
+func New(address string, opts ...Option) *Server {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	cfg.fillDefaults()
 	return &Server{
-		address:  address,
-		connMap:  sync.Map{},
-		messages: make(chan *message, 1000),
-		group:    new(sync.WaitGroup),
+		Config:       cfg,
+		address:      address,
+		connMap:      sync.Map{},
+		messages:     make(chan *message, cfg.MessageQueueSize),
+		group:        new(sync.WaitGroup),
+		quit:         make(chan struct{}),
+		sessions:     map[string]*connection{},
+		rooms:        map[string]*room{},
+		privateRooms: map[privateKey]*room{},
+		memberOf:     map[string]map[*room]bool{},
+		nicks:        map[string]string{},
+		nickOf:       map[string]string{},
 	}
 }
 
 type message struct {
 	author    string
 	recipient string
-	data      []byte
+	frame     *msg.Frame
+	// confirm room request is confirmed to its author
+	confirm bool
+	// encoded frame variants, shared by all recipients negotiated the same capabilities
+	encoded map[encoding][]byte
 }
 
-// Serve starts server
-func (s *Server) Serve() {
+// Accept retry delays after temporary errors
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Serve listens on server address, or uses Config.Listener, and serves connections until Stop.
+// It returns net.ErrClosed after Stop
+func (s *Server) Serve() error {
+	if s.Listener != nil {
+		return s.ServeListener(s.Listener)
+	}
 	l, err := net.Listen("tcp", s.address)
 	if err != nil {
-		panic(err.Error())
+		return err
+	}
+	return s.ServeListener(l)
+}
+
+// ServeListener serves connections accepted from l until Stop, l is closed by Stop.
+// Temporary accept errors are retried with growing delay, other errors are returned
+func (s *Server) ServeListener(l net.Listener) error {
+	s.mu.Lock()
+	if s.stopping() {
+		s.mu.Unlock()
+		_ = l.Close()
+		return net.ErrClosed
 	}
 	s.listener = l
+	s.dispatch.Add(1)
+	s.mu.Unlock()
 	go s.sendMessages()
+
+	var delay time.Duration
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return net.ErrClosed
+			}
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Temporary() { //nolint:staticcheck // EMFILE is reported as temporary only
+				return err
+			}
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			s.Logger.Printf("accept error: %s, retrying in %s\n", err, delay)
+			time.Sleep(delay)
 			continue
 		}
+		delay = 0
+		if !s.track() {
+			_ = conn.Close()
+			return net.ErrClosed
+		}
+		go s.serveConn(conn)
+	}
+}
 
-		connID := uuid.NewV4().String()
-		s.connMap.Store(connID, conn)
-		err = s.notifyNewClient(connID)
-		if err != nil {
-			log.Printf("can't init connection %q", conn.RemoteAddr().String())
-			return
+// track adds connection to the group waited by Stop, it returns false when server is stopping
+func (s *Server) track() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping() {
+		return false
+	}
+	s.group.Add(1)
+	return true
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.group.Done()
+	reader := msg.NewReader(conn, s.MaxFrameSize)
+	defer reader.Release()
+	c, err := s.handshake(conn, reader)
+	if err != nil {
+		s.Logger.Printf("handshake with %q failed: %s\n", conn.RemoteAddr().String(), err)
+		_ = conn.Close()
+		return
+	}
+	s.serve(c, reader, !c.resumed)
+}
+
+// serve runs connection writer, heartbeat and reader, announce puts the new client into DefaultRoom
+func (s *Server) serve(c *connection, reader *msg.Reader, announce bool) {
+	reader.SetSync(c.caps[msg.CapSync])
+	reader.OnSkip = func(n int) {
+		s.Logger.Printf("skipped %d bytes from %q - %q\n", n, c.conn.RemoteAddr().String(), c.id)
+		if s.OnResync != nil {
+			s.OnResync(c.id, n)
 		}
-		go s.handleConnection(connID, conn)
 	}
+
+	s.connMap.Store(c.id, c)
+	s.trackSession(c)
+	go s.writeLoop(c)
+	go s.heartbeat(c)
+	if s.stopping() {
+		// Stop may have missed the connection
+		c.close()
+		s.connMap.Delete(c.id)
+		return
+	}
+	if announce {
+		s.joinDefaultRoom(c.id)
+	}
+	s.handleConnection(c, reader)
+}
+
+// Run serves connections until ctx is done, then stops server within StopTimeout.
+// It returns the first fatal error of Serve or nil if server is stopped by ctx
+func (s *Server) Run(ctx context.Context) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve()
+	}()
+
+	var err error
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+	}
+	stopCtx, cancel := context.WithTimeout(context.Background(), s.StopTimeout)
+	defer cancel()
+	s.Stop(stopCtx)
+	if err == nil {
+		err = <-served
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
 }
 
-// Stop stops server, closes connections
+// Stop stops accepting connections, announces shutdown to clients after their queued frames
+// and closes connections. Clients not drained until ctx is done are closed at once
 func (s *Server) Stop(ctx context.Context) {
-	s.stops = true
-	done := make(chan struct{})
+	s.stop(ctx, s.ReconnectHint)
+}
 
+// StopReconnect stops server like Stop, but tells clients to reconnect after the reconnect time
+// instead of ReconnectHint, it is meant for restarts
+func (s *Server) StopReconnect(ctx context.Context, reconnect time.Duration) {
+	s.stop(ctx, reconnect)
+}
+
+func (s *Server) stop(ctx context.Context, reconnect time.Duration) {
+	s.mu.Lock()
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	s.mu.Unlock()
+	s.dispatch.Wait()
+
+	s.drain(ctx, reconnect)
+
+	done := make(chan struct{})
 	go func() {
 		s.group.Wait()
 		close(done)
 	}()
 
 	s.connMap.Range(func(connID, value interface{}) bool {
-		conn, ok := value.(net.Conn)
+		c, ok := value.(*connection)
 		if ok {
-			_ = conn.Close()
+			c.close()
 		}
 		return true
 	})
 
 	select {
 	case <-ctx.Done():
-		if s.listener != nil {
-			_ = s.listener.Close()
-		}
 	case <-done:
-		if s.listener != nil {
-			_ = s.listener.Close()
+	}
+}
+
+// drain sends shutdown frame after the queued frames of every connection and waits until they are written.
+// It is called after sendMessages stops, so outbound queues get no more frames
+func (s *Server) drain(ctx context.Context, reconnect time.Duration) {
+	m := &message{frame: msg.Shutdown(s.ShutdownMessage, reconnect)}
+	var draining []*connection
+	s.connMap.Range(func(connID, value interface{}) bool {
+		c, ok := value.(*connection)
+		if !ok {
+			return true
+		}
+		data, err := s.encoded(m, c)
+		if err != nil {
+			s.Logger.Printf("can't encode shutdown frame to %q: %s", c.id, err)
+			return true
+		}
+		select {
+		case c.bye <- data:
+			draining = append(draining, c)
+		default:
+		}
+		return true
+	})
+
+	for _, c := range draining {
+		select {
+		case <-c.stopped:
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func (s *Server) handleConnection(connID string, conn net.Conn) {
-	s.group.Add(1)
-	log.Printf("serving %q - %q\n", conn.RemoteAddr().String(), connID)
+func (s *Server) stopping() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// push puts message into the dispatch queue, messages pushed after Stop are dropped and false is returned
+func (s *Server) push(m *message) bool {
+	select {
+	case s.messages <- m:
+		return true
+	case <-s.quit:
+		return false
+	}
+}
+
+func (s *Server) handleConnection(c *connection, reader *msg.Reader) {
+	connID, conn := c.id, c.conn
+	s.Logger.Printf("serving %q - %q\n", conn.RemoteAddr().String(), connID)
 	defer func() {
-		log.Printf("closing connection %q\n", conn.RemoteAddr().String())
-		_ = conn.Close()
-		s.connMap.Delete(connID)
-		s.group.Done()
+		if !c.isParked() {
+			s.connMap.Delete(connID)
+		}
+		if s.handingOff() {
+			// Handoff closes connection after its socket is duplicated
+			return
+		}
+		s.Logger.Printf("closing connection %q\n", conn.RemoteAddr().String())
+		c.close()
 	}()
 
-	reader := bufio.NewReader(conn)
 	for {
-		data, err := msg.Read(reader)
+		if deadline := s.readDeadline(c); !deadline.IsZero() {
+			_ = conn.SetReadDeadline(deadline)
+		}
+		f, err := reader.Read()
 		if err != nil {
-			if s.stops {
+			if s.stopping() {
+				c.unread = reader.Unread()
 				return
 			}
-			if err == io.EOF {
-				s.clientDisconnectNotify(connID)
+			var checksumErr *msg.ChecksumError
+			corrupted := errors.As(err, &checksumErr)
+			if corrupted {
+				s.Logger.Printf("corrupted frame from %q - %q: %s\n", conn.RemoteAddr().String(), connID, err)
+				if !s.DropCorrupted {
+					continue
+				}
+			}
+			// connection is closing from here on
+			if !s.retire(c) {
+				// session is resumed on another connection
 				return
 			}
-			log.Printf("wrong message format from %q\n", conn.RemoteAddr().String())
-			break
+			if reason, ok := s.sessionLimit(c, err); ok {
+				s.Logger.Printf("closing %q - %q: %s\n", conn.RemoteAddr().String(), connID, msg.ReasonText(reason))
+				s.goodbye(c, reason)
+				s.clientDisconnectNotify(connID, reason)
+				return
+			}
+			var reason uint8 = msg.ReasonCorrupted
+			if !corrupted {
+				reason = s.readErrorReason(connID, conn, err)
+			}
+			if evicted := c.evictReason(); evicted != 0 {
+				reason = evicted
+			}
+			if s.park(c, reason) {
+				return
+			}
+			s.clientDisconnectNotify(connID, reason)
+			return
 		}
-		content, _ := msg.Decode(data)
-		if !strings.HasPrefix(content, msg.ClientMessageHeaderPrefix) {
-			log.Printf("wrong content format from %q\n", conn.RemoteAddr().String())
+		c.alive()
+		if f.Type == msg.HeaderTypeGoodbye {
+			// client leaves for good, its session is not kept
+			if s.retire(c) {
+				s.clientDisconnectNotify(connID, msg.ReasonLeft)
+			}
+			return
 		}
+		if f.Type == msg.HeaderTypePong {
+			c.pong(f)
+			continue
+		}
+		switch f.Type {
+		case msg.HeaderTypeClientMessage, msg.HeaderTypeJoinRoom, msg.HeaderTypeLeaveRoom, msg.HeaderTypeInvite,
+			msg.HeaderTypeListRooms, msg.HeaderTypeSetTopic, msg.HeaderTypeSetNick:
+		default:
+			s.Logger.Printf("wrong content format from %q\n", conn.RemoteAddr().String())
+			continue
+		}
+
+		c.active = time.Now()
 
+		// fragments are forwarded one by one, so other clients messages are interleaved with a long message
+		f.Version = msg.Version
+		f.Sender = connID
 		m := &message{
-			author: connID,
-			data:   data,
+			author:    connID,
+			recipient: f.Recipient,
+			frame:     f,
+			confirm:   f.Type != msg.HeaderTypeClientMessage,
 		}
-		if recipient := s.getRecipient(data); recipient != "" {
-			m.recipient = recipient
+		if !s.push(m) {
+			// server stops, the frame is kept for handoff
+			if data, err := s.encoded(m, c); err == nil {
+				c.unread = append(append([]byte{}, data...), reader.Unread()...)
+			}
+			return
 		}
-		s.messages <- m
 	}
 }
 
-func (s *Server) sendMessages() {
-	writeMessage := func(connID string, connValue interface{}, m *message) {
-		conn, ok := connValue.(net.Conn)
-		if !ok {
-			log.Printf("can't send message to %q, connection is failed", connID)
-			return
-		}
-		if _, err := conn.Write(m.data); err != nil {
-			log.Printf("can't send message to %q", connID)
-		}
+// readErrorReason logs read error and returns disconnect reason for it
+func (s *Server) readErrorReason(connID string, conn net.Conn, err error) uint8 {
+	switch err {
+	case io.EOF:
+		return msg.ReasonLeft
+	case msg.ErrTooBig:
+		s.Logger.Printf("too big message from %q - %q\n", conn.RemoteAddr().String(), connID)
+		return msg.ReasonCorrupted
+	case msg.ErrWrongFormat:
+		s.Logger.Printf("wrong message format from %q - %q\n", conn.RemoteAddr().String(), connID)
+		return msg.ReasonCorrupted
+	default:
+		s.Logger.Printf("can't read from %q - %q: %s\n", conn.RemoteAddr().String(), connID, err)
+		return msg.ReasonError
 	}
+}
 
-	for message := range s.messages {
-		if s.stops {
-			return
-		}
-		message := message
-
-		if message.recipient != "" {
-			conn, ok := s.connMap.Load(message.recipient)
-			if !ok {
-				log.Printf("client %q does not connected", message.recipient)
+// sendMessages dispatches messages into outbound queues of recipients,
+// on Stop it routes messages left in the dispatch queue and returns
+func (s *Server) sendMessages() {
+	defer s.dispatch.Done()
+	for {
+		select {
+		case m := <-s.messages:
+			s.route(m)
+		case <-s.quit:
+			// messages accepted before Stop are delivered by drain
+			for {
+				select {
+				case m := <-s.messages:
+					s.route(m)
+				default:
+					return
+				}
 			}
-			writeMessage(message.recipient, conn, message)
-			continue
 		}
-
-		s.connMap.Range(func(key, value interface{}) bool {
-			connID, ok := key.(string)
-			if !ok {
-				return true
-			}
-
-			if connID == message.author {
-				return true
-			}
-
-			writeMessage(connID, value, message)
-			return true
-		})
 	}
 }
 
-func (s *Server) getRecipient(m []byte) string {
-	if len(m) < 3 || m[18] != '@' {
-		return ""
+// route handles room requests and puts message into queue of its recipient or of room members.
+// Messages without recipient go to DefaultRoom, direct messages are addressed by ID or nickname
+func (s *Server) route(m *message) {
+	switch m.frame.Type {
+	case msg.HeaderTypeJoinRoom:
+		s.join(m)
+		return
+	case msg.HeaderTypeLeaveRoom:
+		s.leave(m)
+		return
+	case msg.HeaderTypeInvite:
+		s.invite(m)
+		return
+	case msg.HeaderTypeListRooms:
+		s.listRooms(m)
+		return
+	case msg.HeaderTypeSetTopic:
+		s.setTopic(m)
+		return
+	case msg.HeaderTypeSetNick:
+		s.setNick(m)
+		return
+	case msg.HeaderTypeDisconnectClient:
+		s.disconnect(m)
+		return
 	}
 
-	recipientID := uuid.FromStringOrNil(string(m[19:55]))
-	if recipientID == uuid.Nil {
-		return ""
+	if m.recipient == "" {
+		s.broadcast(m, s.DefaultRoom)
+		return
+	}
+	if name, ok := msg.RoomName(m.recipient); ok {
+		s.broadcast(m, name)
+		return
+	}
+	id := s.resolve(m.recipient)
+	value, ok := s.connMap.Load(id)
+	if !ok {
+		s.Logger.Printf("client %q does not connected", m.recipient)
+		s.replyError(m.author, msg.ErrCodeNoClient, fmt.Sprintf("client %s is not connected", m.recipient))
+		return
 	}
-	return recipientID.String()
+	if id != m.recipient {
+		// message to nickname is delivered with recipient ID
+		f := *m.frame
+		f.Recipient = id
+		m.frame = &f
+	}
+	s.deliver(value, m)
 }
 
-func (s *Server) notifyNewClient(connID string) error {
-	newClientHeader, err := msg.Encode("[new-client]" + connID)
+// deliverTo puts message into queue of the client, messages to unknown clients are dropped
+func (s *Server) deliverTo(id string, m *message) {
+	value, ok := s.connMap.Load(id)
+	if !ok {
+		return
+	}
+	s.deliver(value, m)
+}
+
+func (s *Server) deliver(connValue interface{}, m *message) {
+	c, ok := connValue.(*connection)
+	if !ok {
+		s.Logger.Printf("can't send message, connection is failed")
+		return
+	}
+	data, err := s.encoded(m, c)
 	if err != nil {
-		return errors.New("can't notify about new client")
+		s.Logger.Printf("can't encode message to %q: %s", c.id, err)
+		return
 	}
-	s.messages <- &message{
-		author: connID,
-		data:   newClientHeader,
+	s.enqueue(c, data)
+}
+
+// encoded returns message encoded for connection, every encoding variant is built once
+// and reused for all connections negotiated the same capabilities
+func (s *Server) encoded(m *message, c *connection) ([]byte, error) {
+	e := c.encoding()
+	if data, ok := m.encoded[e]; ok {
+		return data, nil
 	}
 
-	s.connMap.Range(func(id, value interface{}) bool {
-		if id == connID {
-			return true
-		}
-		clientHeader, err := msg.Encode("[clients-list]" + id.(string))
+	f := m.frame
+	if e.flags&msg.FlagCompressed != 0 {
+		cf, err := msg.Compress(f, s.CompressThreshold)
 		if err != nil {
-			return true
-		}
-		s.messages <- &message{
-			recipient: connID,
-			data:      clientHeader,
+			return nil, err
 		}
-		return true
-	})
-
-	return nil
-}
-
-func (s *Server) clientDisconnectNotify(id string) {
-	disconnectHeader, err := msg.Encode(fmt.Sprintf("%s%s", "[client-disconnect]", id))
+		f = cf
+	}
+	if e.flags&msg.FlagChecksum != 0 {
+		cf := *f
+		cf.Flags |= msg.FlagChecksum
+		f = &cf
+	}
+	data, err := msg.Encode(f)
 	if err != nil {
-		log.Println("fail to send disconnect header", err)
+		return nil, err
 	}
-	s.messages <- &message{
-		author: id,
-		data:   disconnectHeader,
+	if e.sync {
+		data = append(msg.Magic[:], data...)
+	}
+	if m.encoded == nil {
+		m.encoded = map[encoding][]byte{}
 	}
+	m.encoded[e] = data
+	return data, nil
+}
+
+func (s *Server) clientDisconnectNotify(id string, reason uint8) {
+	s.push(&message{
+		author: id,
+		frame:  msg.DisconnectClient(id, s.nick(id), reason),
+	})
 }
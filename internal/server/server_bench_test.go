@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	msg "tcp-serv-test/internal/message"
+)
+
+const (
+	benchClients = 1000
+	// benchWindow max count of broadcasts in flight, keeps outbound queues from overflowing
+	benchWindow = 1024
+)
+
+type benchEnv struct {
+	s        *Server
+	address  string
+	conns    []net.Conn
+	received int64
+}
+
+// newBenchEnv starts server with benchClients connected clients, every client counts received chat messages
+func newBenchEnv(b *testing.B, port int, writeBatch int, writeLinger time.Duration) *benchEnv {
+	e := &benchEnv{address: ":" + strconv.Itoa(port)}
+	e.s = New(e.address)
+	e.s.QueueSize = 2 * benchWindow
+	e.s.WriteBatch = writeBatch
+	e.s.WriteLinger = writeLinger
+	go e.s.Serve()
+
+	for i := 0; i < benchClients; i++ {
+		conn, err := buildClient(e.address)
+		if err != nil {
+			b.Fatal(err)
+		}
+		e.conns = append(e.conns, conn)
+		go e.drain(conn)
+	}
+	return e
+}
+
+func (e *benchEnv) drain(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Time{})
+	r := msg.NewReader(conn, msg.DefaultMaxSize)
+	defer r.Release()
+	for {
+		f, err := r.ReadView()
+		if err != nil {
+			return
+		}
+		if f.Type == msg.HeaderTypeClientMessage {
+			atomic.AddInt64(&e.received, 1)
+		}
+	}
+}
+
+func (e *benchEnv) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	e.s.Stop(ctx)
+	for _, conn := range e.conns {
+		_ = conn.Close()
+	}
+}
+
+func (e *benchEnv) waitReceived(b *testing.B, want int64) {
+	deadline := time.Now().Add(time.Minute)
+	for atomic.LoadInt64(&e.received) < want {
+		if time.Now().After(deadline) {
+			b.Fatalf("received %d of %d messages", atomic.LoadInt64(&e.received), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+var benchModes = []struct {
+	name   string
+	batch  int
+	linger time.Duration
+}{
+	{"unbatched", 1, 0},
+	{"batched", DefaultWriteBatch, DefaultWriteLinger},
+}
+
+// BenchmarkServer_Broadcast one client broadcasts to benchClients-1 clients
+func BenchmarkServer_Broadcast(b *testing.B) {
+	for i, mode := range benchModes {
+		e := newBenchEnv(b, 8090+i, mode.batch, mode.linger)
+		data, _ := msg.Encode(&msg.Frame{
+			Version: msg.Version,
+			Type:    msg.HeaderTypeClientMessage,
+			Payload: []byte("hello, this is a regular chat message"),
+		})
+
+		b.Run(mode.name, func(b *testing.B) {
+			atomic.StoreInt64(&e.received, 0)
+			writes := atomic.LoadUint64(&e.s.writes)
+			start := time.Now()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if n >= benchWindow && n%benchWindow == 0 {
+					e.waitReceived(b, int64((n-benchWindow)*(benchClients-1)))
+				}
+				if _, err := e.conns[0].Write(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+			frames := int64(b.N * (benchClients - 1))
+			e.waitReceived(b, frames)
+			b.StopTimer()
+
+			b.ReportMetric(float64(atomic.LoadUint64(&e.s.writes)-writes)/float64(b.N), "writes/op")
+			b.ReportMetric(float64(frames)/time.Since(start).Seconds(), "frames/s")
+		})
+		e.close()
+	}
+}
+
+// BenchmarkServer_JoinStorm a client joins benchClients connected clients and waits for the whole clients list
+func BenchmarkServer_JoinStorm(b *testing.B) {
+	for i, mode := range benchModes {
+		e := newBenchEnv(b, 8092+i, mode.batch, mode.linger)
+
+		b.Run(mode.name, func(b *testing.B) {
+			writes := atomic.LoadUint64(&e.s.writes)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				conn, err := buildClient(e.address)
+				if err != nil {
+					b.Fatal(err)
+				}
+				r := msg.NewReader(conn, msg.DefaultMaxSize)
+				for listed := 0; listed < benchClients; {
+					f, err := r.ReadView()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if f.Type == msg.HeaderTypeClientList {
+						listed++
+					}
+				}
+				r.Release()
+				_ = conn.Close()
+			}
+			b.StopTimer()
+
+			b.ReportMetric(float64(atomic.LoadUint64(&e.s.writes)-writes)/float64(b.N), "writes/op")
+		})
+		e.close()
+	}
+}
@@ -1,14 +1,29 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	msg "tcp-serv-test/internal/message"
+
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
 )
 
 func TestServer_Serve(t *testing.T) {
@@ -33,19 +48,20 @@ func TestServer_Serve(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.HasPrefix(string(m[2:]), "[new-client]") {
+	if m.Type != msg.HeaderTypeNewClient {
 		t.Fatal("conn1 didn't get new-client header from conn2")
 	}
-	conn2ID := strings.TrimPrefix(string(m[2:]), "[new-client]")
+	conn2ID := m.Sender
 
 	_ = conn2.SetReadDeadline(time.Now().Add(10 * time.Second))
 	m, err = msg.Read(conn2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.HasPrefix(string(m[2:]), "[clients-list]") {
-		t.Fatalf("conn2 didn't get clients-list header from conn1, %s", m)
+	if m.Type != msg.HeaderTypeClientList {
+		t.Fatalf("conn2 didn't get clients-list header from conn1, %v", m)
 	}
+	conn1ID := m.Sender
 
 	time.Sleep(1 * time.Second)
 	conn3, err := buildClient(address)
@@ -71,19 +87,25 @@ func TestServer_Serve(t *testing.T) {
 	}
 
 	// broadcast
-	expectedMsg := []byte{0, 1, 'A'}
-	_, err = conn1.Write(expectedMsg)
+	data, _ := msg.Encode(&msg.Frame{Version: msg.Version, Type: msg.HeaderTypeClientMessage, Payload: []byte("A")})
+	_, err = conn1.Write(data)
 	if err != nil {
 		t.Fatal(err)
 	}
+	expectedMsg := &msg.Frame{
+		Version: msg.Version,
+		Type:    msg.HeaderTypeClientMessage,
+		Sender:  conn1ID,
+		Payload: []byte("A"),
+	}
 
 	_ = conn2.SetReadDeadline(time.Now().Add(10 * time.Second))
 	m, err = msg.Read(conn2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(m, expectedMsg) {
-		t.Fatalf("message is not equal with expected\nActual:   %b\nExpected: %b", m, expectedMsg)
+	if !reflect.DeepEqual(m, expectedMsg) {
+		t.Fatalf("message is not equal with expected\nActual:   %v\nExpected: %v", m, expectedMsg)
 	}
 
 	_ = conn3.SetReadDeadline(time.Now().Add(10 * time.Second))
@@ -91,37 +113,55 @@ func TestServer_Serve(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(m, expectedMsg) {
-		t.Fatalf("message is not equal with expected\nActual:   %b\nExpected: %b", m, expectedMsg)
+	if !reflect.DeepEqual(m, expectedMsg) {
+		t.Fatalf("message is not equal with expected\nActual:   %v\nExpected: %v", m, expectedMsg)
 	}
 
 	// direct
-	expectedMsg, _ = msg.Encode("@" + conn2ID + "test msg")
-	_, err = conn1.Write(expectedMsg)
+	data, _ = msg.Encode(&msg.Frame{
+		Version:   msg.Version,
+		Type:      msg.HeaderTypeClientMessage,
+		Recipient: conn2ID,
+		Payload:   []byte("test msg"),
+	})
+	_, err = conn1.Write(data)
 	if err != nil {
 		t.Fatal(err)
 	}
+	expectedMsg = &msg.Frame{
+		Version:   msg.Version,
+		Type:      msg.HeaderTypeClientMessage,
+		Sender:    conn1ID,
+		Recipient: conn2ID,
+		Payload:   []byte("test msg"),
+	}
 
 	_ = conn2.SetReadDeadline(time.Now().Add(10 * time.Second))
 	m, err = msg.Read(conn2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(m, expectedMsg) {
-		t.Fatalf("message is not equal with expected\nActual:   %b\nExpected: %b", m, expectedMsg)
+	if !reflect.DeepEqual(m, expectedMsg) {
+		t.Fatalf("message is not equal with expected\nActual:   %v\nExpected: %v", m, expectedMsg)
 	}
 
 	_ = conn3.SetReadDeadline(time.Now().Add(2 * time.Second))
 	m, err = msg.Read(conn3)
 	if err == nil {
-		t.Fatalf("conn3 received message directed to conn2, message: %b", m)
+		t.Fatalf("conn3 received message directed to conn2, message: %v", m)
 	}
 	if !strings.Contains(err.Error(), "i/o timeout") {
 		t.Fatalf("unexpected error %e", err)
 	}
 }
 
-func buildClient(address string) (net.Conn, error) {
+func buildClient(address string, caps ...string) (net.Conn, error) {
+	conn, _, err := buildClientID(address, caps...)
+	return conn, err
+}
+
+// buildClientID connects to server and returns connection with its assigned ID
+func buildClientID(address string, caps ...string) (net.Conn, string, error) {
 	var err error
 	for i := 0; i < 10; i++ {
 		var conn net.Conn
@@ -133,7 +173,1757 @@ func buildClient(address string) (net.Conn, error) {
 		tcpConn := conn.(*net.TCPConn)
 		_ = tcpConn.SetKeepAlive(true)
 		_ = tcpConn.SetKeepAlivePeriod(30 * time.Second)
-		return tcpConn, nil
+		var welcome *msg.Frame
+		welcome, err = handshake(tcpConn, msg.Hello(caps))
+		if err != nil {
+			return nil, "", err
+		}
+		return tcpConn, welcome.Recipient, nil
+	}
+	return nil, "", err
+}
+
+func handshake(conn net.Conn, hello *msg.Frame) (*msg.Frame, error) {
+	data, err := msg.Encode(hello)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(data); err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	return msg.Read(conn)
+}
+
+func TestServer_Handshake(t *testing.T) {
+	address := ":8082"
+	s := New(address)
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	conn, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name     string
+		hello    *msg.Frame
+		wantType uint8
+		wantCode uint16
+	}{
+		{"welcome", msg.Hello([]string{"unknown"}), msg.HeaderTypeWelcome, 0},
+		{"incompatible version", &msg.Frame{Version: msg.Version + 1, Type: msg.HeaderTypeHello}, msg.HeaderTypeError, msg.ErrCodeVersion},
+		{"no hello", &msg.Frame{Version: msg.Version, Type: msg.HeaderTypeClientMessage}, msg.HeaderTypeError, msg.ErrCodeHandshake},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			got, err := handshake(c, tt.hello)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Type != tt.wantType {
+				t.Fatalf("handshake reply type = %d, want %d", got.Type, tt.wantType)
+			}
+			if tt.wantType == msg.HeaderTypeWelcome {
+				if uuid.FromStringOrNil(got.Recipient) == uuid.Nil {
+					t.Fatalf("welcome has no connection ID: %v", got)
+				}
+				if len(got.Payload) != 0 {
+					t.Fatalf("unknown capabilities agreed: %s", got.Payload)
+				}
+				return
+			}
+			protoErr, err := msg.ParseError(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if protoErr.Code != tt.wantCode {
+				t.Fatalf("error code = %d, want %d", protoErr.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestServer_Compression(t *testing.T) {
+	address := ":8083"
+	s := New(address)
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	sender, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	compressing, err := buildClient(address, msg.CapCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressing.Close()
+	raw, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	payload := bytes.Repeat([]byte("compressible "), 100)
+	data, _ := msg.Encode(&msg.Frame{Version: msg.Version, Type: msg.HeaderTypeClientMessage, Payload: payload})
+	if _, err = sender.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for conn, wantCompressed := range map[net.Conn]bool{compressing: true, raw: false} {
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		r := bufio.NewReader(conn)
+		for {
+			header, err := r.Peek(msg.HeaderSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compressed := header[2]&msg.FlagCompressed != 0
+			m, err := msg.Read(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Type != msg.HeaderTypeClientMessage {
+				continue
+			}
+			if compressed != wantCompressed {
+				t.Fatalf("compressed on wire = %v, want %v", compressed, wantCompressed)
+			}
+			if !bytes.Equal(m.Payload, payload) {
+				t.Fatalf("payload is not equal with sent")
+			}
+			break
+		}
+	}
+}
+
+func TestServer_CorruptedFrame(t *testing.T) {
+	tests := []struct {
+		name          string
+		address       string
+		dropCorrupted bool
+	}{
+		{"skip corrupted frame", ":8084", false},
+		{"drop connection", ":8085", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.address)
+			s.DropCorrupted = tt.dropCorrupted
+			go s.Serve()
+			defer s.Stop(context.Background())
+
+			sender, err := buildClient(tt.address, msg.CapChecksum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sender.Close()
+			receiver, err := buildClient(tt.address, msg.CapChecksum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer receiver.Close()
+
+			corrupted, _ := msg.Encode(&msg.Frame{
+				Version: msg.Version,
+				Type:    msg.HeaderTypeClientMessage,
+				Flags:   msg.FlagChecksum,
+				Payload: []byte("corrupted"),
+			})
+			corrupted[len(corrupted)-msg.ChecksumSize-1] ^= 0xff
+			valid, _ := msg.Encode(&msg.Frame{
+				Version: msg.Version,
+				Type:    msg.HeaderTypeClientMessage,
+				Flags:   msg.FlagChecksum,
+				Payload: []byte("valid"),
+			})
+			if _, err = sender.Write(append(corrupted, valid...)); err != nil {
+				t.Fatal(err)
+			}
+
+			_ = receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+			for {
+				m, err := msg.Read(receiver)
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch m.Type {
+				case msg.HeaderTypeClientMessage:
+					if tt.dropCorrupted || string(m.Payload) != "valid" {
+						t.Fatalf("unexpected message %q", m.Payload)
+					}
+					return
+				case msg.HeaderTypeDisconnectClient:
+					if !tt.dropCorrupted {
+						t.Fatal("sender is disconnected after corrupted frame")
+					}
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestServer_ChecksumErrorThenDrop(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	s := New(address, WithListener(l), WithResumeWindow(200*time.Millisecond), WithLogger(log.New(io.Discard, "", 0)))
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	peer, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	sender, senderID, err := buildClientID(address, msg.CapChecksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted, _ := msg.Encode(&msg.Frame{
+		Version: msg.Version,
+		Type:    msg.HeaderTypeClientMessage,
+		Flags:   msg.FlagChecksum,
+		Payload: []byte("corrupted"),
+	})
+	corrupted[len(corrupted)-msg.ChecksumSize-1] ^= 0xff
+	if _, err = sender.Write(corrupted); err != nil {
+		t.Fatal(err)
+	}
+	// the session survives the recoverable error and ends when the client is gone
+	settle(t, sender)
+	_ = sender.Close()
+	for {
+		if f := nextFrame(t, peer); f.Type == msg.HeaderTypeDisconnectClient && f.Sender == senderID {
+			break
+		}
+	}
+	if rooms := s.memberRooms(senderID); len(rooms) != 0 {
+		t.Errorf("dropped client is still in rooms %v", rooms)
+	}
+}
+
+func TestServer_Resync(t *testing.T) {
+	address := ":8086"
+	s := New(address)
+	skipped := make(chan int, 1)
+	s.OnResync = func(connID string, n int) {
+		skipped <- n
+	}
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	sender, err := buildClient(address, msg.CapSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := buildClient(address, msg.CapSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	data, _ := msg.Encode(&msg.Frame{Version: msg.Version, Type: msg.HeaderTypeClientMessage, Payload: []byte("A")})
+	garbage := []byte{0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	stream := append(append(garbage, msg.Magic[:]...), data...)
+	if _, err = sender.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case n := <-skipped:
+		if n != len(garbage) {
+			t.Fatalf("skipped = %d, want %d", n, len(garbage))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("resync is not reported")
+	}
+
+	r := msg.NewReader(receiver, msg.DefaultMaxSize)
+	r.SetSync(true)
+	_ = receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		m, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Type == msg.HeaderTypeClientMessage {
+			if string(m.Payload) != "A" {
+				t.Fatalf("unexpected message %q", m.Payload)
+			}
+			break
+		}
+	}
+	if r.Skipped() != 0 {
+		t.Fatalf("receiver skipped %d bytes of server stream", r.Skipped())
+	}
+}
+
+func TestServer_SlowConsumer(t *testing.T) {
+	tests := []struct {
+		name       string
+		address    string
+		policy     OverflowPolicy
+		wantEvicts bool
+	}{
+		{"drop oldest", ":8087", DropOldest, false},
+		{"drop newest", ":8088", DropNewest, false},
+		{"disconnect", ":8089", Disconnect, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.address)
+			s.QueueSize = 4
+			s.OverflowPolicy = tt.policy
+			go s.Serve()
+			defer s.Stop(context.Background())
+
+			slow, slowID, err := buildClientID(tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer slow.Close()
+
+			sender, err := buildClient(tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sender.Close()
+			data, _ := msg.Encode(&msg.Frame{
+				Version: msg.Version,
+				Type:    msg.HeaderTypeClientMessage,
+				Payload: []byte(randString(60 << 10)),
+			})
+			for i := 0; i < 400; i++ {
+				if _, err = sender.Write(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deadline := time.Now().Add(3 * time.Second)
+			for time.Now().Before(deadline) {
+				depth, ok := s.QueueDepth(slowID)
+				if !ok {
+					if !tt.wantEvicts {
+						t.Fatal("slow client is disconnected")
+					}
+					return
+				}
+				if depth > s.QueueSize {
+					t.Fatalf("QueueDepth() = %d, want at most %d", depth, s.QueueSize)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if tt.wantEvicts {
+				t.Fatal("slow client is not disconnected")
+			}
+		})
+	}
+}
+
+func randString(l int) string {
+	b := make([]byte, l)
+	for i := range b {
+		b[i] = byte('a' + rand.Intn(26))
+	}
+	return string(b)
+}
+
+func TestServer_WriteTimeoutEviction(t *testing.T) {
+	address := ":8079"
+	s := New(address)
+	s.QueueSize = 1000
+	s.WriteTimeout = 100 * time.Millisecond
+	s.MaxWriteTimeouts = 2
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	observer, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer observer.Close()
+	slow, slowID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	evicted := make(chan uint8, 1)
+	go func() {
+		r := msg.NewReader(observer, msg.DefaultMaxSize)
+		_ = observer.SetReadDeadline(time.Now().Add(30 * time.Second))
+		for {
+			f, err := r.ReadView()
+			if err != nil {
+				return
+			}
+			if f.Type == msg.HeaderTypeDisconnectClient && f.Sender == slowID {
+				evicted <- msg.DisconnectReason(f)
+				return
+			}
+		}
+	}()
+
+	data, _ := msg.Encode(&msg.Frame{
+		Version: msg.Version,
+		Type:    msg.HeaderTypeClientMessage,
+		Payload: []byte(randString(60 << 10)),
+	})
+	go func() {
+		for i := 0; i < 400; i++ {
+			if _, err := observer.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case reason := <-evicted:
+		if reason != msg.ReasonSlowConsumer {
+			t.Fatalf("disconnect reason = %d, want %d", reason, msg.ReasonSlowConsumer)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("slow client is not evicted")
+	}
+}
+
+func TestServer_Heartbeat(t *testing.T) {
+	address := ":8078"
+	s := New(address)
+	s.HeartbeatInterval = 50 * time.Millisecond
+	s.HeartbeatMisses = 2
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	alive, aliveID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	silent, silentID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	evicted := make(chan uint8, 1)
+	go func() {
+		r := msg.NewReader(alive, msg.DefaultMaxSize)
+		w := msg.NewWriter(alive)
+		_ = alive.SetReadDeadline(time.Now().Add(10 * time.Second))
+		for {
+			f, err := r.ReadView()
+			if err != nil {
+				return
+			}
+			switch {
+			case f.Type == msg.HeaderTypePing:
+				if err = w.Write(msg.Pong(f)); err != nil {
+					return
+				}
+			case f.Type == msg.HeaderTypeDisconnectClient && f.Sender == silentID:
+				evicted <- msg.DisconnectReason(f)
+			}
+		}
+	}()
+
+	select {
+	case reason := <-evicted:
+		if reason != msg.ReasonHeartbeat {
+			t.Fatalf("disconnect reason = %d, want %d", reason, msg.ReasonHeartbeat)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent client is not evicted")
+	}
+
+	rtt, ok := s.RTT(aliveID)
+	if !ok {
+		t.Fatal("client replying to pings is evicted")
+	}
+	if rtt <= 0 {
+		t.Errorf("RTT() = %v, want measured round-trip time", rtt)
+	}
+}
+
+func TestServer_SessionLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		idle    time.Duration
+		session time.Duration
+		chat    bool
+		want    uint8
+	}{
+		{"idle timeout", ":8076", 200 * time.Millisecond, 0, false, msg.ReasonIdle},
+		{"session expired", ":8077", 200 * time.Millisecond, 600 * time.Millisecond, true, msg.ReasonSessionExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.address)
+			s.IdleTimeout = tt.idle
+			s.MaxSessionTime = tt.session
+			go s.Serve()
+			defer s.Stop(context.Background())
+
+			conn, err := buildClient(tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if tt.chat {
+				data, _ := msg.Encode(&msg.Frame{Version: msg.Version, Type: msg.HeaderTypeClientMessage, Payload: []byte("hi")})
+				go func() {
+					for i := 0; i < 20; i++ {
+						if _, err := conn.Write(data); err != nil {
+							return
+						}
+						time.Sleep(50 * time.Millisecond)
+					}
+				}()
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			r := msg.NewReader(conn, msg.DefaultMaxSize)
+			for {
+				f, err := r.ReadView()
+				if err != nil {
+					t.Fatalf("goodbye is not received: %s", err)
+				}
+				if f.Type != msg.HeaderTypeGoodbye {
+					continue
+				}
+				if reason := msg.DisconnectReason(f); reason != tt.want {
+					t.Fatalf("goodbye reason = %d, want %d", reason, tt.want)
+				}
+				break
+			}
+			if _, err = r.ReadView(); err != io.EOF {
+				t.Errorf("read after goodbye error = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestServer_Options(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids uint32
+	s := New("",
+		WithListener(l),
+		WithLogger(log.New(io.Discard, "", 0)),
+		WithIDGenerator(func() string {
+			return fmt.Sprintf("client-%d", atomic.AddUint32(&ids, 1))
+		}),
+		WithQueueSizes(10, 20),
+	)
+	if cap(s.messages) != 10 || s.QueueSize != 20 {
+		t.Fatalf("queue sizes = %d, %d, want 10, 20", cap(s.messages), s.QueueSize)
+	}
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	for _, want := range []string{"client-1", "client-2"} {
+		conn, id, dialErr := buildClientID(l.Addr().String())
+		if dialErr != nil {
+			t.Fatal(dialErr)
+		}
+		defer conn.Close()
+		if id != want {
+			t.Errorf("connection ID = %q, want %q", id, want)
+		}
+	}
+}
+
+func TestServer_PartialConfig(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("", WithConfig(Config{Listener: l, WriteTimeout: time.Second}))
+	if s.Logger == nil || s.NewID == nil {
+		t.Fatal("logger and ID generator are not set")
+	}
+	if s.MaxWriteTimeouts != DefaultMaxWriteTimeouts || s.QueueSize != DefaultQueueSize || s.WriteBatch != DefaultWriteBatch {
+		t.Errorf("MaxWriteTimeouts, QueueSize, WriteBatch = %d, %d, %d, want defaults",
+			s.MaxWriteTimeouts, s.QueueSize, s.WriteBatch)
+	}
+	if s.HeartbeatInterval != 0 {
+		t.Errorf("heartbeat disabled by zero interval is changed to %v", s.HeartbeatInterval)
+	}
+	if s.DefaultRoom != DefaultRoom {
+		t.Errorf("DefaultRoom = %q, want %q", s.DefaultRoom, DefaultRoom)
+	}
+	if off := New("", WithConfig(Config{NoDefaultRoom: true})); off.DefaultRoom != "" {
+		t.Errorf("DefaultRoom = %q with NoDefaultRoom, want none", off.DefaultRoom)
+	}
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	conn, err := buildClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestServer_LongID(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("",
+		WithListener(l),
+		WithLogger(log.New(io.Discard, "", 0)),
+		WithIDGenerator(func() string { return strings.Repeat("x", msg.MaxIDLen+1) }),
+	)
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sendFrame(t, conn, msg.Hello(nil))
+	if f := nextFrame(t, conn); f.Type != msg.HeaderTypeError {
+		t.Fatalf("frame type = %d, want error", f.Type)
+	}
+}
+
+func TestServer_DispatchDrainsOnStop(t *testing.T) {
+	s := New("", WithLogger(log.New(io.Discard, "", 0)))
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	c := newConnection("a", server, 10)
+	s.connMap.Store(c.id, c)
+
+	for i := 0; i < 3; i++ {
+		s.messages <- &message{recipient: c.id, frame: &msg.Frame{
+			Version:   msg.Version,
+			Type:      msg.HeaderTypeClientMessage,
+			Recipient: c.id,
+			Payload:   []byte(fmt.Sprintf("m%d", i)),
+		}}
+	}
+	close(s.quit)
+	s.dispatch.Add(1)
+	s.sendMessages()
+	if len(c.out) != 3 {
+		t.Fatalf("queued frames = %d, want 3", len(c.out))
+	}
+}
+
+func TestServer_ServeErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	busy := New(l.Addr().String())
+	if err = busy.Serve(); err == nil {
+		t.Fatal("Serve() on busy address error = nil")
+	}
+
+	s := New("")
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ServeListener(l)
+	}()
+	conn, err := buildClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s.Stop(context.Background())
+	select {
+	case err = <-served:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("ServeListener() after Stop error = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeListener() does not return after Stop")
+	}
+}
+
+func TestServer_Run(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err = New(l.Addr().String()).Run(context.Background()); err == nil {
+		t.Fatal("Run() on busy address error = nil")
+	}
+
+	address := "127.0.0.1:8075"
+	s := New(address)
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error, 1)
+	go func() {
+		ran <- s.Run(ctx)
+	}()
+	conn, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cancel()
+	select {
+	case err = <-ran:
+		if err != nil {
+			t.Errorf("Run() after cancel error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() does not return after cancel")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.Copy(io.Discard, conn); err != nil {
+		t.Errorf("connection is not closed by Run(): %s", err)
+	}
+}
+
+func TestServer_Drain(t *testing.T) {
+	address := "127.0.0.1:8074"
+	s := New(address, WithShutdownNotice("maintenance", 30*time.Second))
+	go s.Serve()
+
+	sender, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, receiverID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	const count = 100
+	data, _ := msg.Encode(&msg.Frame{
+		Version:   msg.Version,
+		Type:      msg.HeaderTypeClientMessage,
+		Recipient: receiverID,
+		Payload:   []byte("hi"),
+	})
+	for i := 0; i < count; i++ {
+		if _, err = sender.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_ = receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := msg.NewReader(receiver, msg.DefaultMaxSize)
+	for received := 0; received < count; {
+		f, err := r.ReadView()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Type == msg.HeaderTypeClientMessage {
+			received++
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go s.Stop(ctx)
+
+	var notice *msg.ShutdownNotice
+	for notice == nil {
+		f, err := r.ReadView()
+		if err != nil {
+			t.Fatalf("shutdown frame is not received: %s", err)
+		}
+		if f.Type == msg.HeaderTypeShutdown {
+			if notice, err = msg.ParseShutdown(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	want := &msg.ShutdownNotice{Text: "maintenance", Reconnect: 30 * time.Second}
+	if !reflect.DeepEqual(notice, want) {
+		t.Errorf("shutdown notice = %v, want %v", notice, want)
+	}
+	if _, err = r.ReadView(); err != io.EOF {
+		t.Errorf("read after shutdown frame error = %v, want EOF", err)
+	}
+}
+
+func TestServer_StopReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("", WithListener(l), WithLogger(log.New(io.Discard, "", 0)))
+	go s.Serve()
+
+	conn, err := buildClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	settle(t, conn)
+	go s.StopReconnect(context.Background(), 2*time.Second)
+	for {
+		f := nextFrame(t, conn)
+		if f.Type != msg.HeaderTypeShutdown {
+			continue
+		}
+		notice, parseErr := msg.ParseShutdown(f)
+		if parseErr != nil {
+			t.Fatal(parseErr)
+		}
+		if notice.Reconnect != 2*time.Second || s.ReconnectHint != 0 {
+			t.Errorf("reconnect = %s, ReconnectHint = %s, want 2s and unchanged config", notice.Reconnect, s.ReconnectHint)
+		}
+		return
+	}
+}
+
+func TestServer_Handoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	old := New(address, WithListener(l))
+	go old.Serve()
+
+	sender, senderID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, receiverID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	_ = receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := msg.NewReader(receiver, msg.DefaultMaxSize)
+	for {
+		// wait until sender is known to server and to receiver
+		f, err := r.ReadView()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Type == msg.HeaderTypeClientList && f.Sender == senderID {
+			break
+		}
+	}
+
+	data, _ := msg.Encode(&msg.Frame{
+		Version:   msg.Version,
+		Type:      msg.HeaderTypeClientMessage,
+		Recipient: receiverID,
+		Payload:   []byte("across restart"),
+	})
+	// the frame is cut by handoff
+	if _, err = sender.Write(data[:8]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	lf, err := old.ListenerFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conns, err := old.Handoff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 2 {
+		t.Fatalf("Handoff() returned %d connections, want 2", len(conns))
+	}
+
+	nl, err := net.FileListener(lf)
+	_ = lf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(address, WithListener(nl))
+	go s.Serve()
+	defer s.Stop(context.Background())
+	if err = s.Adopt(conns); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = sender.Write(data[8:]); err != nil {
+		t.Fatal(err)
+	}
+	f, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &msg.Frame{
+		Version:   msg.Version,
+		Type:      msg.HeaderTypeClientMessage,
+		Sender:    senderID,
+		Recipient: receiverID,
+		Payload:   []byte("across restart"),
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("frame after handoff = %v, want %v", f, want)
+	}
+
+	// new server accepts on the inherited listener
+	conn, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+}
+
+func TestServer_Resume(t *testing.T) {
+	address := "127.0.0.1:8073"
+	s := New(address, WithResumeWindow(time.Second))
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	peer, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	welcome, err := handshake(conn, msg.Hello(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := welcome.Recipient
+	_, token := msg.ParseHandshake(welcome)
+	if token == "" {
+		t.Fatal("welcome has no session token")
+	}
+
+	frames := make(chan *msg.Frame, 10)
+	go func() {
+		r := msg.NewReader(peer, msg.DefaultMaxSize)
+		_ = peer.SetReadDeadline(time.Now().Add(10 * time.Second))
+		for {
+			f, err := r.Read()
+			if err != nil {
+				close(frames)
+				return
+			}
+			if f.Sender == id {
+				frames <- f
+			}
+		}
+	}()
+	if f := <-frames; f.Type != msg.HeaderTypeNewClient {
+		t.Fatalf("peer got frame type %d, want new client", f.Type)
+	}
+
+	// dropped without goodbye, the message to it is queued until it comes back
+	_ = conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	data, _ := msg.Encode(&msg.Frame{Version: msg.Version, Type: msg.HeaderTypeClientMessage, Recipient: id, Payload: []byte("missed")})
+	if _, err = peer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err = net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	welcome, err = handshake(conn, msg.Resume(nil, token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if welcome.Recipient != id {
+		t.Fatalf("resumed ID = %q, want %q", welcome.Recipient, id)
+	}
+	f, err := msg.Read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Payload) != "missed" {
+		t.Errorf("resumed client got %q, want queued message", f.Payload)
+	}
+
+	// the old token is used up
+	again, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if welcome, err = handshake(again, msg.Resume(nil, token)); err != nil || welcome.Recipient == id {
+		t.Errorf("second resume with the same token = %v, %v", welcome, err)
+	}
+
+	// leaving with goodbye ends session at once
+	data, _ = msg.Encode(msg.Goodbye(msg.ReasonLeft))
+	if _, err = conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f = <-frames
+	if f == nil || f.Type != msg.HeaderTypeDisconnectClient || msg.DisconnectReason(f) != msg.ReasonLeft {
+		t.Errorf("peer got %v after goodbye, want disconnect", f)
+	}
+}
+
+func TestServer_ResumeLive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	s := New(address, WithListener(l), WithResumeWindow(time.Minute))
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	peer, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	old, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	welcome, err := handshake(old, msg.Hello(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := welcome.Recipient
+	_, token := msg.ParseHandshake(welcome)
+	for {
+		if f := nextFrame(t, peer); f.Type == msg.HeaderTypeNewClient && f.Sender == id {
+			break
+		}
+	}
+
+	// client noticed the drop before server did
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if welcome, err = handshake(conn, msg.Resume(nil, token)); err != nil {
+		t.Fatal(err)
+	}
+	if welcome.Recipient != id {
+		t.Fatalf("resumed ID = %q, want %q", welcome.Recipient, id)
+	}
+	_ = old.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err = msg.Read(old); err != nil {
+			break
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatal("old connection is not closed")
+	}
+
+	sendFrame(t, peer, &msg.Frame{Version: msg.Version, Type: msg.HeaderTypeClientMessage, Recipient: id, Payload: []byte("taken over")})
+	if f := nextFrame(t, conn); string(f.Payload) != "taken over" {
+		t.Errorf("resumed client got %q, want message", f.Payload)
+	}
+	_ = peer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		f, readErr := msg.Read(peer)
+		if readErr != nil {
+			break
+		}
+		if f.Type == msg.HeaderTypeDisconnectClient && f.Sender == id {
+			t.Fatal("peer is told about disconnect of resumed client")
+		}
+	}
+}
+
+func TestServer_HandoffParked(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	s := New(address, WithListener(l), WithResumeWindow(time.Minute))
+	go s.Serve()
+
+	peer, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	dropped, droppedID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if f := nextFrame(t, peer); f.Type == msg.HeaderTypeNewClient && f.Sender == droppedID {
+			break
+		}
+	}
+	_ = dropped.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conns, err := s.Handoff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hc := range conns {
+		_ = hc.File.Close()
+	}
+	if len(conns) != 1 {
+		t.Fatalf("Handoff() returned %d connections, want 1", len(conns))
+	}
+	for {
+		if f := nextFrame(t, peer); f.Type == msg.HeaderTypeDisconnectClient && f.Sender == droppedID {
+			break
+		}
+	}
+}
+
+func TestServer_ResumeExpired(t *testing.T) {
+	address := "127.0.0.1:8072"
+	s := New(address, WithResumeWindow(200*time.Millisecond))
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	peer, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	conn, id, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_ = conn.Close()
+
+	r := msg.NewReader(peer, msg.DefaultMaxSize)
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		f, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Type == msg.HeaderTypeDisconnectClient && f.Sender == id {
+			break
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("disconnect announced after %s, before resume window", elapsed)
+	}
+}
+
+func TestServer_Rooms(t *testing.T) {
+	address := "127.0.0.1:8071"
+	s := New(address, WithDefaultRoom(""))
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	alice, aliceID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, bobID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	eve, _, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eve.Close()
+
+	sendFrame(t, alice, msg.JoinRoom("dev"))
+	if f := nextFrame(t, alice); f.Type != msg.HeaderTypeNewClient || f.Sender != aliceID || msg.Room(f) != "dev" {
+		t.Fatalf("alice got %v, want join confirmation", f)
+	}
+	sendFrame(t, bob, msg.JoinRoom("dev"))
+	if f := nextFrame(t, bob); f.Type != msg.HeaderTypeNewClient || f.Sender != bobID {
+		t.Fatalf("bob got %v, want join confirmation", f)
+	}
+	if f := nextFrame(t, bob); f.Type != msg.HeaderTypeClientList || f.Sender != aliceID || msg.Room(f) != "dev" {
+		t.Fatalf("bob got %v, want alice in member list", f)
+	}
+	if f := nextFrame(t, alice); f.Type != msg.HeaderTypeNewClient || f.Sender != bobID {
+		t.Fatalf("alice got %v, want bob joined", f)
+	}
+
+	// room message reaches members only
+	sendFrame(t, alice, &msg.Frame{Version: msg.Version, Type: msg.HeaderTypeClientMessage, Recipient: msg.RoomRecipient("dev"), Payload: []byte("hi")})
+	if f := nextFrame(t, bob); f.Type != msg.HeaderTypeClientMessage || string(f.Payload) != "hi" || f.Recipient != "#dev" {
+		t.Fatalf("bob got %v, want room message", f)
+	}
+	sendFrame(t, eve, &msg.Frame{Version: msg.Version, Type: msg.HeaderTypeClientMessage, Recipient: msg.RoomRecipient("dev"), Payload: []byte("hi")})
+	f := nextFrame(t, eve)
+	if protoErr, parseErr := msg.ParseError(f); parseErr != nil || protoErr.Code != msg.ErrCodeNotMember {
+		t.Fatalf("eve got %v, want not member error", f)
+	}
+	sendFrame(t, eve, msg.JoinRoom("bad name"))
+	f = nextFrame(t, eve)
+	if protoErr, parseErr := msg.ParseError(f); parseErr != nil || protoErr.Code != msg.ErrCodeRoomName {
+		t.Fatalf("eve got %v, want room name error", f)
+	}
+
+	sendFrame(t, bob, msg.LeaveRoom("dev"))
+	if f = nextFrame(t, alice); f.Type != msg.HeaderTypeLeaveRoom || f.Sender != bobID {
+		t.Fatalf("alice got %v, want bob left", f)
+	}
+	if rooms := s.memberRooms(bobID); len(rooms) != 0 {
+		t.Errorf("bob is still in rooms %v", rooms)
+	}
+
+	// disconnect is told to room members
+	_ = alice.Close()
+	_ = eve.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if f, err = msg.Read(eve); err == nil {
+		t.Errorf("eve got %v from a room of other clients", f)
+	}
+}
+
+func TestServer_PrivateRooms(t *testing.T) {
+	address := "127.0.0.1:8070"
+	s := New(address, WithDefaultRoom(""))
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	owner, ownerID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	guest, guestID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guest.Close()
+
+	expectError := func(conn net.Conn, code uint16) {
+		t.Helper()
+		f := nextFrame(t, conn)
+		if protoErr, parseErr := msg.ParseError(f); parseErr != nil || protoErr.Code != code {
+			t.Fatalf("got %v, want error %d", f, code)
+		}
+	}
+
+	sendFrame(t, owner, msg.JoinRoomWith("ops", msg.RoomOptions{Private: true}))
+	if f := nextFrame(t, owner); f.Type != msg.HeaderTypeNewClient || f.Sender != ownerID {
+		t.Fatalf("owner got %v, want join confirmation", f)
+	}
+	// strangers can't tell private room from missing one
+	sendFrame(t, guest, msg.Invite("ops", ownerID))
+	expectError(guest, msg.ErrCodeRoomUnavailable)
+	sendFrame(t, guest, msg.LeaveRoom("ops"))
+	expectError(guest, msg.ErrCodeNotMember)
+	sendFrame(t, guest, msg.JoinRoom("ops"))
+	if f := nextFrame(t, guest); f.Type != msg.HeaderTypeNewClient || f.Sender != guestID {
+		t.Fatalf("stranger got %v, want join confirmation of a room of its own", f)
+	}
+	sendFrame(t, guest, msg.LeaveRoom("ops"))
+	if f := nextFrame(t, guest); f.Type != msg.HeaderTypeLeaveRoom || f.Sender != guestID {
+		t.Fatalf("stranger got %v, want leave confirmation", f)
+	}
+
+	sendFrame(t, owner, msg.Invite("ops", "unknown"))
+	expectError(owner, msg.ErrCodeNoClient)
+	sendFrame(t, owner, msg.Invite("ops", guestID))
+	if f := nextFrame(t, guest); f.Type != msg.HeaderTypeInvite || f.Sender != ownerID || msg.Room(f) != "ops" {
+		t.Fatalf("guest got %v, want invitation", f)
+	}
+	if f := nextFrame(t, owner); f.Type != msg.HeaderTypeInvite || f.Recipient != guestID {
+		t.Fatalf("owner got %v, want invitation confirmation", f)
+	}
+	sendFrame(t, guest, msg.JoinRoom("ops"))
+	if f := nextFrame(t, guest); f.Type != msg.HeaderTypeNewClient || f.Sender != guestID {
+		t.Fatalf("invited guest got %v, want join confirmation", f)
+	}
+	if f := nextFrame(t, guest); f.Type != msg.HeaderTypeClientList || f.Sender != ownerID {
+		t.Fatalf("invited guest got %v, want member list", f)
+	}
+	if f := nextFrame(t, owner); f.Type != msg.HeaderTypeNewClient || f.Sender != guestID {
+		t.Fatalf("owner got %v, want guest joined", f)
+	}
+	sendFrame(t, guest, msg.Invite("ops", guestID))
+	expectError(guest, msg.ErrCodeNotOwner)
+
+	sendFrame(t, owner, msg.JoinRoomWith("vault", msg.RoomOptions{Password: "secret"}))
+	if f := nextFrame(t, owner); f.Type != msg.HeaderTypeNewClient || msg.Room(f) != "vault" {
+		t.Fatalf("owner got %v, want join confirmation", f)
+	}
+	sendFrame(t, guest, msg.JoinRoomWith("vault", msg.RoomOptions{Password: "guess"}))
+	expectError(guest, msg.ErrCodeWrongPassword)
+	sendFrame(t, guest, msg.JoinRoomWith("vault", msg.RoomOptions{Password: "secret"}))
+	if f := nextFrame(t, guest); f.Type != msg.HeaderTypeNewClient || msg.Room(f) != "vault" {
+		t.Fatalf("guest got %v, want join confirmation", f)
+	}
+
+	// room settings survive handoff
+	next := New(address)
+	next.AdoptRooms(s.HandoffRooms())
+	if r := next.privateRooms[privateKey{owner: ownerID, name: "ops"}]; r == nil || !r.private || r.owner != ownerID {
+		t.Errorf("adopted room = %+v, want private room of owner", r)
+	}
+	if r := next.rooms["vault"]; r == nil || r.admit(guestID, "secret") != 0 || r.admit(guestID, "guess") == 0 {
+		t.Errorf("adopted room = %+v, want room with password", r)
+	}
+}
+
+func TestServer_PrivateRoomNames(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("", WithListener(l), WithDefaultRoom(""), WithLogger(log.New(io.Discard, "", 0)))
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	owner, ownerID, err := buildClientID(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	stranger, strangerID, err := buildClientID(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+
+	// names of private rooms can't be spelled by strangers
+	sendFrame(t, stranger, msg.JoinRoom("ops\x00"+ownerID))
+	if protoErr, parseErr := msg.ParseError(nextFrame(t, stranger)); parseErr != nil || protoErr.Code != msg.ErrCodeRoomName {
+		t.Fatalf("join of scoped name = %v, want invalid room name", protoErr)
+	}
+
+	// public and private rooms of the same name live apart
+	sendFrame(t, stranger, msg.JoinRoom("ops"))
+	if f := nextFrame(t, stranger); f.Type != msg.HeaderTypeNewClient || f.Sender != strangerID {
+		t.Fatalf("stranger got %v, want join confirmation", f)
+	}
+	sendFrame(t, owner, msg.JoinRoomWith("ops", msg.RoomOptions{Private: true}))
+	if f := nextFrame(t, owner); f.Type != msg.HeaderTypeNewClient || f.Sender != ownerID {
+		t.Fatalf("owner got %v, want join confirmation of private room", f)
+	}
+	sendFrame(t, owner, msg.LeaveRoom("ops"))
+	if f := nextFrame(t, owner); f.Type != msg.HeaderTypeLeaveRoom || f.Sender != ownerID {
+		t.Fatalf("owner got %v, want leave confirmation", f)
+	}
+	sendFrame(t, stranger, msg.SetTopic("ops", "still here"))
+	if f := nextFrame(t, stranger); f.Type != msg.HeaderTypeSetTopic || f.Sender != strangerID {
+		t.Fatalf("stranger got %v, want topic changed in its room", f)
+	}
+}
+
+func TestServer_DefaultRoomOpen(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("", WithListener(l))
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	conn, id, err := buildClientID(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a client left alone in the lobby can't lock it for new clients
+	sendFrame(t, conn, msg.LeaveRoom(DefaultRoom))
+	if f := nextFrame(t, conn); f.Type != msg.HeaderTypeLeaveRoom || f.Sender != id {
+		t.Fatalf("got %v, want leave confirmation", f)
+	}
+	for _, opts := range []msg.RoomOptions{{Password: "mine"}, {Private: true}} {
+		sendFrame(t, conn, msg.JoinRoomWith(DefaultRoom, opts))
+		if protoErr, parseErr := msg.ParseError(nextFrame(t, conn)); parseErr != nil || protoErr.Code != msg.ErrCodeRoomUnavailable {
+			t.Fatalf("join of default room with %+v = %v, want room unavailable", opts, protoErr)
+		}
+	}
+}
+
+func TestServer_RoomDirectory(t *testing.T) {
+	address := "127.0.0.1:8069"
+	s := New(address)
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	alice, aliceID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	// alice is in the lobby before bob comes
+	settle(t, alice)
+	bob, bobID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if f := nextFrame(t, alice); f.Type != msg.HeaderTypeNewClient || f.Sender != bobID {
+		t.Fatalf("alice got %v, want bob joined", f)
+	}
+	if f := nextFrame(t, bob); f.Type != msg.HeaderTypeClientList || f.Sender != aliceID {
+		t.Fatalf("bob got %v, want member list", f)
+	}
+
+	sendFrame(t, alice, msg.JoinRoomWith("ops", msg.RoomOptions{Private: true}))
+	nextFrame(t, alice)
+	sendFrame(t, alice, msg.JoinRoomWith("vault", msg.RoomOptions{Password: "secret"}))
+	nextFrame(t, alice)
+	sendFrame(t, alice, msg.SetTopic(DefaultRoom, "welcome"))
+	for _, conn := range []net.Conn{alice, bob} {
+		f := nextFrame(t, conn)
+		if room, topic := msg.ParseTopic(f); f.Type != msg.HeaderTypeSetTopic || f.Sender != aliceID || room != DefaultRoom || topic != "welcome" {
+			t.Fatalf("got %v, want topic changed", f)
+		}
+	}
+	sendFrame(t, bob, msg.SetTopic("ops", "mine"))
+	if protoErr, parseErr := msg.ParseError(nextFrame(t, bob)); parseErr != nil || protoErr.Code != msg.ErrCodeNotMember {
+		t.Fatalf("bob changed topic of a room without joining it: %v", protoErr)
+	}
+
+	listRooms := func(conn net.Conn) []msg.RoomInfo {
+		t.Helper()
+		sendFrame(t, conn, msg.ListRooms())
+		rooms, parseErr := msg.ParseRoomList(nextFrame(t, conn))
+		if parseErr != nil {
+			t.Fatal(parseErr)
+		}
+		return rooms
+	}
+	lobby := msg.RoomInfo{Name: DefaultRoom, Topic: "welcome", Members: 2, Visibility: msg.VisibilityPublic}
+	if rooms := listRooms(bob); !reflect.DeepEqual(rooms, []msg.RoomInfo{lobby}) {
+		t.Errorf("bob sees rooms %v, want lobby only", rooms)
+	}
+	ops := msg.RoomInfo{Name: "ops", Members: 1, Visibility: msg.VisibilityPrivate}
+	vault := msg.RoomInfo{Name: "vault", Members: 1, Visibility: msg.VisibilityPassword}
+	if rooms := listRooms(alice); !reflect.DeepEqual(rooms, []msg.RoomInfo{lobby, ops, vault}) {
+		t.Errorf("alice sees rooms %v, want lobby, ops and vault", rooms)
+	}
+
+	// new member gets the topic after the member list
+	carol, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Close()
+	for {
+		f := nextFrame(t, carol)
+		if f.Type == msg.HeaderTypeClientList {
+			continue
+		}
+		if _, topic := msg.ParseTopic(f); f.Type != msg.HeaderTypeSetTopic || topic != "welcome" {
+			t.Fatalf("carol got %v, want topic", f)
+		}
+		break
+	}
+}
+
+func TestServer_Nicks(t *testing.T) {
+	address := "127.0.0.1:8068"
+	s := New(address)
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	alice, aliceID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	settle(t, alice)
+	bob, bobID, err := buildClientID(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if f := nextFrame(t, alice); f.Type != msg.HeaderTypeNewClient || f.Sender != bobID {
+		t.Fatalf("alice got %v, want bob joined", f)
+	}
+	if f := nextFrame(t, bob); f.Type != msg.HeaderTypeClientList || f.Sender != aliceID {
+		t.Fatalf("bob got %v, want member list", f)
+	}
+
+	expectError := func(conn net.Conn, code uint16) {
+		t.Helper()
+		f := nextFrame(t, conn)
+		if protoErr, parseErr := msg.ParseError(f); parseErr != nil || protoErr.Code != code {
+			t.Fatalf("got %v, want error %d", f, code)
+		}
+	}
+
+	sendFrame(t, alice, msg.SetNick("Alice"))
+	for _, conn := range []net.Conn{alice, bob} {
+		if f := nextFrame(t, conn); f.Type != msg.HeaderTypeSetNick || f.Sender != aliceID || msg.Nick(f) != "Alice" {
+			t.Fatalf("got %v, want nick changed", f)
+		}
+	}
+	sendFrame(t, bob, msg.SetNick("alice"))
+	expectError(bob, msg.ErrCodeNickTaken)
+	sendFrame(t, bob, msg.SetNick("Admin"))
+	expectError(bob, msg.ErrCodeNickReserved)
+	sendFrame(t, bob, msg.SetNick("2bob"))
+	expectError(bob, msg.ErrCodeNickInvalid)
+	sendFrame(t, bob, msg.SetNick(aliceID))
+	if f := nextFrame(t, bob); f.Type != msg.HeaderTypeError {
+		t.Fatalf("bob took connection ID of alice as nickname: %v", f)
+	}
+	sendFrame(t, bob, msg.SetNick("bob"))
+	for _, conn := range []net.Conn{bob, alice} {
+		if f := nextFrame(t, conn); f.Type != msg.HeaderTypeSetNick || f.Sender != bobID || msg.Nick(f) != "bob" {
+			t.Fatalf("got %v, want nick changed", f)
+		}
+	}
+
+	carol, err := buildClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Close()
+	nicks := map[string]string{}
+	for len(nicks) < 2 {
+		f := nextFrame(t, carol)
+		if f.Type != msg.HeaderTypeClientList {
+			t.Fatalf("carol got %v, want member list", f)
+		}
+		nicks[f.Sender] = msg.Nick(f)
+	}
+	if nicks[aliceID] != "Alice" || nicks[bobID] != "bob" {
+		t.Errorf("member list nicknames = %v", nicks)
+	}
+	for _, conn := range []net.Conn{alice, bob} {
+		if f := nextFrame(t, conn); f.Type != msg.HeaderTypeNewClient {
+			t.Fatalf("got %v, want carol joined", f)
+		}
+	}
+
+	// direct message by nickname is delivered with recipient ID
+	sendFrame(t, bob, &msg.Frame{Version: msg.Version, Type: msg.HeaderTypeClientMessage, Recipient: "ALICE", Payload: []byte("hi")})
+	if f := nextFrame(t, alice); f.Type != msg.HeaderTypeClientMessage || f.Sender != bobID || f.Recipient != aliceID {
+		t.Fatalf("alice got %v, want direct message", f)
+	}
+	sendFrame(t, bob, &msg.Frame{Version: msg.Version, Type: msg.HeaderTypeClientMessage, Recipient: "nobody", Payload: []byte("hi")})
+	expectError(bob, msg.ErrCodeNoClient)
+
+	_ = bob.Close()
+	if f := nextFrame(t, alice); f.Type != msg.HeaderTypeDisconnectClient || msg.Nick(f) != "bob" {
+		t.Fatalf("alice got %v, want bob disconnected", f)
+	}
+	sendFrame(t, alice, msg.SetNick("bob"))
+	if f := nextFrame(t, alice); f.Type != msg.HeaderTypeSetNick {
+		t.Errorf("nickname of disconnected client is not freed: %v", f)
+	}
+}
+
+func TestServer_Auth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	users := NewMemoryAuthenticator()
+	users.Add("alice", "secret")
+	users.Add("bob", "hunter2")
+	s := New(address, WithListener(l), WithAuthenticator(users))
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	login := func(hello *msg.Frame, auth *msg.Frame) (net.Conn, *msg.Frame) {
+		t.Helper()
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendFrame(t, conn, hello)
+		sendFrame(t, conn, auth)
+		return conn, nextFrame(t, conn)
+	}
+
+	bob, welcome := login(msg.Hello(nil), msg.Auth("bob", "hunter2"))
+	defer bob.Close()
+	if welcome.Type != msg.HeaderTypeWelcome {
+		t.Fatalf("bob got %v, want welcome", welcome)
+	}
+
+	tests := []struct {
+		name string
+		auth *msg.Frame
+	}{
+		{"message instead of credentials", &msg.Frame{Version: msg.Version, Type: msg.HeaderTypeClientMessage}},
+		{"unknown user", msg.Auth("mallory", "secret")},
+		{"wrong password", msg.Auth("alice", "guess")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, f := login(msg.Hello(nil), tt.auth)
+			defer conn.Close()
+			if protoErr, err := msg.ParseError(f); err != nil || protoErr.Code != msg.ErrCodeAuth {
+				t.Fatalf("got %v, want auth error", f)
+			}
+		})
+	}
+
+	alice, welcome := login(msg.Hello(nil), msg.Auth("alice", "secret"))
+	defer alice.Close()
+	if welcome.Type != msg.HeaderTypeWelcome {
+		t.Fatalf("alice got %v, want welcome", welcome)
+	}
+	// rejected clients are not announced
+	if f := nextFrame(t, bob); f.Type != msg.HeaderTypeNewClient || f.Sender != welcome.Recipient || msg.Nick(f) != "alice" {
+		t.Fatalf("bob got %v, want alice joined with nickname", f)
+	}
+	if f := nextFrame(t, alice); f.Type != msg.HeaderTypeClientList || msg.Nick(f) != "bob" {
+		t.Fatalf("alice got %v, want bob in member list", f)
+	}
+	sendFrame(t, alice, msg.SetNick("bob2"))
+	if protoErr, parseErr := msg.ParseError(nextFrame(t, alice)); parseErr != nil || protoErr.Code != msg.ErrCodeNickLocked {
+		t.Fatalf("authenticated client changed nickname: %v", protoErr)
+	}
+}
+
+func TestServer_AuthMissing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("",
+		WithListener(l),
+		WithLogger(log.New(io.Discard, "", 0)),
+		WithAuthenticator(NewMemoryAuthenticator()),
+		WithHandshakeTimeout(200*time.Millisecond),
+	)
+	go s.Serve()
+	defer s.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// client without credentials waits for welcome
+	sendFrame(t, conn, msg.Hello(nil))
+	f := nextFrame(t, conn)
+	if protoErr, parseErr := msg.ParseError(f); parseErr != nil || protoErr.Code != msg.ErrCodeAuth {
+		t.Fatalf("got %v, want auth error", f)
+	}
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scryptSum, err := scryptHash("hunter2", []byte("salt"), scryptParams{logN: 4, r: 8, p: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := fmt.Sprintf("# chat users\nalice:%s\n\nbob:%s\n", bcryptHash, scryptSum)
+	if err = os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewFileAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, password string
+		want           error
+	}{
+		{"alice", "secret", nil},
+		{"alice", "hunter2", ErrBadCredentials},
+		{"bob", "hunter2", nil},
+		{"bob", "secret", ErrBadCredentials},
+		{"carol", "secret", ErrBadCredentials},
+	}
+	for _, tt := range tests {
+		if err = a.Authenticate(tt.user, tt.password); !errors.Is(err, tt.want) {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", tt.user, tt.password, err, tt.want)
+		}
+	}
+
+	// invalid file keeps loaded users
+	if err = os.WriteFile(path, []byte("alice:plain\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Reload(); err == nil {
+		t.Error("Reload() accepted plain text password")
+	}
+	if err = a.Authenticate("alice", "secret"); err != nil {
+		t.Errorf("Authenticate() after failed reload = %v", err)
+	}
+}
+
+// scryptHash returns scrypt hash of password in password file format
+func scryptHash(password string, salt []byte, params scryptParams) (string, error) {
+	key, err := scrypt.Key([]byte(password), salt, 1<<params.logN, params.r, params.p, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%sln=%d,r=%d,p=%d$%s$%s", scryptPrefix, params.logN, params.r, params.p,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// settle waits until server handles the lobby join of the client and frames the client sent before,
+// the room list reply is routed after them. Frames got before the reply are skipped
+func settle(t *testing.T, conn net.Conn) {
+	t.Helper()
+	sendFrame(t, conn, msg.ListRooms())
+	for nextFrame(t, conn).Type != msg.HeaderTypeRoomList {
+	}
+}
+
+func sendFrame(t *testing.T, conn net.Conn, f *msg.Frame) {
+	t.Helper()
+	data, err := msg.Encode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nextFrame reads frame skipping pings
+func nextFrame(t *testing.T, conn net.Conn) *msg.Frame {
+	t.Helper()
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		f, err := msg.Read(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Type != msg.HeaderTypePing {
+			return f
+		}
 	}
-	return nil, err
 }
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	msg "tcp-serv-test/internal/message"
+)
+
+// readDeadline returns time when connection hits IdleTimeout or MaxSessionTime, zero time if limits are disabled
+func (s *Server) readDeadline(c *connection) time.Time {
+	var deadline time.Time
+	if s.IdleTimeout > 0 {
+		deadline = c.active.Add(s.IdleTimeout)
+	}
+	if s.MaxSessionTime > 0 {
+		end := c.started.Add(s.MaxSessionTime)
+		if deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+		}
+	}
+	return deadline
+}
+
+// sessionLimit returns disconnect reason if read error is caused by IdleTimeout or MaxSessionTime
+func (s *Server) sessionLimit(c *connection, err error) (uint8, bool) {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return 0, false
+	}
+	if s.MaxSessionTime > 0 && !time.Now().Before(c.started.Add(s.MaxSessionTime)) {
+		return msg.ReasonSessionExpired, true
+	}
+	if s.IdleTimeout > 0 {
+		return msg.ReasonIdle, true
+	}
+	return 0, false
+}
+
+// goodbye sends goodbye frame with the reason to client and waits for the connection writer to stop
+func (s *Server) goodbye(c *connection, reason uint8) {
+	data, err := s.encoded(&message{frame: msg.Goodbye(reason)}, c)
+	if err == nil {
+		select {
+		case c.bye <- data:
+		default:
+		}
+	}
+	<-c.stopped
+}